@@ -0,0 +1,94 @@
+package influxdb_v2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultAckInterval = 500 * time.Millisecond
+	maxAckInterval     = 5 * time.Second
+)
+
+// waitForAck polls the status URL announced in the Location header of a 202
+// response until the server confirms the write with 200 or 204, backing off
+// between attempts. The write is considered delivered right away if no
+// status URL is given.
+func (c *httpClient) waitForAck(ctx context.Context, bucket string, resp *http.Response) error {
+	status := resp.Header.Get("Location")
+	if status == "" {
+		c.log.Debugf("Write to %s was accepted without a status URL, not waiting for acknowledgment", bucket)
+		return nil
+	}
+	loc, err := resp.Request.URL.Parse(status)
+	if err != nil {
+		return fmt.Errorf("invalid status URL %q: %w", status, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.AckTimeout)
+	defer cancel()
+
+	interval := c.AckInterval
+	for {
+		pending, err := c.pollAck(ctx, loc.String(), bucket)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return err
+		}
+		if !pending {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		interval *= 2
+		if interval > maxAckInterval {
+			interval = maxAckInterval
+		}
+	}
+	return fmt.Errorf("write to %s not acknowledged within %s", bucket, c.AckTimeout)
+}
+
+// pollAck queries the status of an accepted write once and returns true if
+// the write is still pending.
+func (c *httpClient) pollAck(ctx context.Context, loc, bucket string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", loc, nil)
+	if err != nil {
+		return false, err
+	}
+	c.addHeaders(req)
+	if auth, ok := c.bucketAuth[bucket]; ok {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	c.limitBody(resp)
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return false, nil
+	case http.StatusAccepted:
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return true, nil
+	}
+	return false, fmt.Errorf("acknowledgment of write to %s failed: %w", bucket, &APIError{
+		StatusCode:  resp.StatusCode,
+		Title:       resp.Status,
+		Description: errorDescription(resp),
+	})
+}
@@ -0,0 +1,120 @@
+package influxdb_v2
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/testutil"
+)
+
+func TestWriteWaitForAck(t *testing.T) {
+	tests := []struct {
+		name       string
+		timeout    time.Duration
+		location   string
+		statuses   []int
+		polls      int64
+		shouldFail bool
+	}{
+		{
+			name:     "acknowledged",
+			timeout:  time.Second,
+			location: "/status/1",
+			statuses: []int{http.StatusAccepted, http.StatusAccepted, http.StatusNoContent},
+			polls:    3,
+		},
+		{
+			name:     "disabled",
+			location: "/status/1",
+			statuses: []int{http.StatusAccepted},
+		},
+		{
+			name:    "no status url",
+			timeout: time.Second,
+		},
+		{
+			name:       "failed",
+			timeout:    time.Second,
+			location:   "/status/1",
+			statuses:   []int{http.StatusAccepted, http.StatusInternalServerError},
+			polls:      2,
+			shouldFail: true,
+		},
+		{
+			name:       "timeout",
+			timeout:    100 * time.Millisecond,
+			location:   "/status/1",
+			statuses:   []int{http.StatusAccepted},
+			shouldFail: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var polls int64
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/v2/write":
+					if tt.location != "" {
+						w.Header().Set("Location", tt.location)
+					}
+					w.WriteHeader(http.StatusAccepted)
+				case "/status/1":
+					require.Equal(t, "GET", r.Method)
+					require.Equal(t, "Token secret", r.Header.Get("Authorization"))
+					n := atomic.AddInt64(&polls, 1)
+					if n > int64(len(tt.statuses)) {
+						n = int64(len(tt.statuses))
+					}
+					w.WriteHeader(tt.statuses[n-1])
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer ts.Close()
+
+			client, err := NewHTTPClient(&HTTPConfig{
+				URL:         genURL(ts.URL),
+				Token:       "secret",
+				Bucket:      "telegraf",
+				AckTimeout:  tt.timeout,
+				AckInterval: 10 * time.Millisecond,
+				Log:         testutil.Logger{},
+			})
+			require.NoError(t, err)
+
+			metrics := []telegraf.Metric{
+				testutil.MustMetric("cpu", map[string]string{},
+					map[string]interface{}{"value": 42.0}, time.Unix(0, 0)),
+			}
+			err = client.Write(context.Background(), metrics)
+			if tt.shouldFail {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			if tt.polls > 0 {
+				require.Equal(t, tt.polls, atomic.LoadInt64(&polls))
+			}
+			if tt.timeout == 0 {
+				require.Zero(t, atomic.LoadInt64(&polls))
+			}
+		})
+	}
+}
+
+func TestAckIntervalInvalid(t *testing.T) {
+	_, err := NewHTTPClient(&HTTPConfig{
+		URL:         genURL("http://localhost:8086"),
+		Bucket:      "telegraf",
+		AckTimeout:  time.Second,
+		AckInterval: -time.Second,
+	})
+	require.Error(t, err)
+}
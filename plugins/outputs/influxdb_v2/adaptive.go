@@ -0,0 +1,73 @@
+package influxdb_v2
+
+import (
+	"sync"
+	"time"
+)
+
+// compressionLatencyWeight is the weight of the latest write latency in the
+// moving average.
+const compressionLatencyWeight = 0.2
+
+// compressionAdapter decides whether to compress request bodies based on an
+// exponentially weighted moving average of the write latency. Compression is
+// skipped while writes are fast, as the network is not the bottleneck then,
+// and used again once they are slow. The gap between the thresholds avoids
+// flapping.
+type compressionAdapter struct {
+	sync.Mutex
+	low     time.Duration
+	high    time.Duration
+	average float64
+	samples int
+	skip    bool
+}
+
+// observe adds the latency of a write to the moving average.
+func (a *compressionAdapter) observe(latency time.Duration) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.samples == 0 {
+		a.average = float64(latency)
+	} else {
+		a.average = compressionLatencyWeight*float64(latency) + (1-compressionLatencyWeight)*a.average
+	}
+	a.samples++
+}
+
+// update decides whether to skip compression for the following writes. It
+// returns true if the decision changed.
+func (a *compressionAdapter) update() bool {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.samples == 0 {
+		return false
+	}
+	skip := a.skip
+	switch {
+	case a.average < float64(a.low):
+		skip = true
+	case a.average > float64(a.high):
+		skip = false
+	}
+	changed := skip != a.skip
+	a.skip = skip
+	return changed
+}
+
+func (a *compressionAdapter) skipped() bool {
+	a.Lock()
+	defer a.Unlock()
+	return a.skip
+}
+
+// contentEncoding returns the content encoding for the next write, which is
+// "identity" while adaptive compression skips compressing.
+func (c *httpClient) contentEncoding() string {
+	if c.compression != nil && c.compression.skipped() {
+		return "identity"
+	}
+	return c.ContentEncoding
+}
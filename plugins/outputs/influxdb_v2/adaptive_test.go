@@ -0,0 +1,117 @@
+package influxdb_v2
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/testutil"
+)
+
+func TestCompressionAdapter(t *testing.T) {
+	a := &compressionAdapter{low: 10 * time.Millisecond, high: 500 * time.Millisecond}
+
+	// Compress until latencies were observed
+	require.False(t, a.update())
+	require.False(t, a.skipped())
+
+	a.observe(time.Millisecond)
+	require.True(t, a.update())
+	require.True(t, a.skipped())
+
+	// Latencies between the thresholds keep the decision
+	for i := 0; i < 20; i++ {
+		a.observe(50 * time.Millisecond)
+		require.False(t, a.update())
+	}
+	require.True(t, a.skipped())
+
+	// A single slow write does not flip the decision right away
+	a.observe(time.Second)
+	require.False(t, a.update())
+	require.True(t, a.skipped())
+
+	for i := 0; i < 5; i++ {
+		a.observe(time.Second)
+	}
+	require.True(t, a.update())
+	require.False(t, a.skipped())
+}
+
+func TestWriteAdaptiveCompression(t *testing.T) {
+	var encodings []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body)
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	client, err := NewHTTPClient(&HTTPConfig{
+		URL:                    genURL(ts.URL),
+		Bucket:                 "telegraf",
+		ContentEncoding:        "gzip",
+		AdaptiveCompression:    true,
+		CompressionLatencyLow:  time.Second,
+		CompressionLatencyHigh: 2 * time.Second,
+		Log:                    testutil.Logger{},
+	})
+	require.NoError(t, err)
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{},
+			map[string]interface{}{"value": 42.0}, time.Unix(0, 0)),
+	}
+
+	// The first write is compressed, the following ones are fast enough to
+	// skip compression
+	require.NoError(t, client.Write(context.Background(), metrics))
+	require.NoError(t, client.Write(context.Background(), metrics))
+	require.Equal(t, []string{"gzip", ""}, encodings)
+}
+
+func TestAdaptiveCompressionInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config HTTPConfig
+	}{
+		{
+			name: "no compression",
+			config: HTTPConfig{
+				ContentEncoding:        "identity",
+				CompressionLatencyLow:  time.Millisecond,
+				CompressionLatencyHigh: time.Second,
+			},
+		},
+		{
+			name: "missing thresholds",
+			config: HTTPConfig{
+				ContentEncoding: "gzip",
+			},
+		},
+		{
+			name: "inverted thresholds",
+			config: HTTPConfig{
+				ContentEncoding:        "gzip",
+				CompressionLatencyLow:  time.Second,
+				CompressionLatencyHigh: time.Millisecond,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			config.URL = genURL("http://localhost:8086")
+			config.Bucket = "telegraf"
+			config.AdaptiveCompression = true
+			_, err := NewHTTPClient(&config)
+			require.Error(t, err)
+		})
+	}
+}
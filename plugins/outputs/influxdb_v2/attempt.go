@@ -0,0 +1,44 @@
+package influxdb_v2
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+// batchAttempts counts the failed attempts of writing each batch, so a batch
+// resent unchanged is recognized as a retry while fresh batches are not. At
+// most limit failed batches are remembered, further ones are written as
+// first attempts when resent.
+type batchAttempts struct {
+	limit int
+
+	sync.Mutex
+	failed map[[sha256.Size]byte]int
+}
+
+// number returns the number of failed attempts of the batch with the given
+// key, zero meaning it is written for the first time.
+func (a *batchAttempts) number(key [sha256.Size]byte) int {
+	a.Lock()
+	defer a.Unlock()
+
+	return a.failed[key]
+}
+
+// done records the result of writing the batch with the given key.
+func (a *batchAttempts) done(key [sha256.Size]byte, err error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if err == nil {
+		delete(a.failed, key)
+		return
+	}
+	if _, ok := a.failed[key]; !ok && len(a.failed) >= a.limit {
+		return
+	}
+	if a.failed == nil {
+		a.failed = make(map[[sha256.Size]byte]int)
+	}
+	a.failed[key]++
+}
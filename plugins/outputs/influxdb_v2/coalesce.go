@@ -0,0 +1,136 @@
+package influxdb_v2
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+const (
+	// defaultCoalesceBytes is the size of the coalesced metrics of a bucket
+	// at which they are written without waiting for the window to expire.
+	defaultCoalesceBytes = 64 * 1024
+
+	// maxCoalescedBuckets limits the number of buckets with coalesced
+	// metrics, batches for further buckets are written right away.
+	maxCoalescedBuckets = 100
+)
+
+type coalesceBuffer struct {
+	metrics []telegraf.Metric
+	size    int64
+	timer   *time.Timer
+	// pending holds the IDs of the collected metrics in the pending queue
+	pending []uint64
+}
+
+// coalescer collects small batches per bucket to write them in a single
+// request once the window since the first batch expired or the collected
+// metrics reach the size limit.
+type coalescer struct {
+	window  time.Duration
+	limit   int64
+	write   func(ctx context.Context, bucket string, metrics []telegraf.Metric) error
+	pending *pendingQueue
+
+	sync.Mutex
+	buffers map[string]*coalesceBuffer
+	wg      sync.WaitGroup
+}
+
+func newCoalescer(window time.Duration, limit int64, pending *pendingQueue, write func(context.Context, string, []telegraf.Metric) error) *coalescer {
+	return &coalescer{
+		window:  window,
+		limit:   limit,
+		write:   write,
+		pending: pending,
+		buffers: make(map[string]*coalesceBuffer),
+	}
+}
+
+// add collects the metrics of the given size for the bucket and returns the
+// metrics to be written right away, if any. Metrics collected earlier are
+// prepended to keep the order of the metrics. Collected metrics are pending
+// until written, the returned IDs must be passed to the pending queue once
+// the returned metrics are handled.
+func (c *coalescer) add(bucket string, metrics []telegraf.Metric, size int64) ([]telegraf.Metric, []uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	buf, ok := c.buffers[bucket]
+	if !ok && (size >= c.limit || len(c.buffers) >= maxCoalescedBuckets) {
+		return metrics, nil
+	}
+	if !ok {
+		buf = &coalesceBuffer{}
+		buf.timer = time.AfterFunc(c.window, func() { c.expire(bucket, buf) })
+		c.buffers[bucket] = buf
+	}
+
+	buf.metrics = append(buf.metrics, metrics...)
+	buf.size += size
+	if buf.size < c.limit {
+		buf.pending = append(buf.pending, c.pending.add(len(metrics), time.Now()))
+		return nil, nil
+	}
+
+	buf.timer.Stop()
+	delete(c.buffers, bucket)
+	return buf.metrics, buf.pending
+}
+
+// expire writes the metrics of the given buffer if they were not written
+// in the meantime.
+func (c *coalescer) expire(bucket string, buf *coalesceBuffer) {
+	c.Lock()
+	if c.buffers[bucket] != buf {
+		c.Unlock()
+		return
+	}
+	delete(c.buffers, bucket)
+	c.wg.Add(1)
+	c.Unlock()
+
+	defer c.wg.Done()
+	// Nobody waits for the result, the error is logged by the write
+	_ = c.write(context.Background(), bucket, buf.metrics)
+	c.pending.done(buf.pending...)
+}
+
+// flush writes all collected metrics and waits for writes of expired
+// windows to complete. The first error of writing the collected metrics is
+// returned.
+func (c *coalescer) flush(ctx context.Context) error {
+	c.Lock()
+	buffers := c.buffers
+	c.buffers = make(map[string]*coalesceBuffer)
+	c.Unlock()
+
+	var firstErr error
+	for bucket, buf := range buffers {
+		buf.timer.Stop()
+		if err := c.write(ctx, bucket, buf.metrics); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		c.pending.done(buf.pending...)
+	}
+	c.wg.Wait()
+	return firstErr
+}
+
+// writeCoalesced writes metrics collected by the coalescer. The metrics were
+// accepted by Write already and cannot be retried, so failed metrics are
+// logged and dropped before returning the error.
+func (c *httpClient) writeCoalesced(ctx context.Context, bucket string, metrics []telegraf.Metric) error {
+	c.coalesceMu.Lock()
+	defer c.coalesceMu.Unlock()
+
+	if err := c.sendBatches(ctx, bucket, metrics); err != nil {
+		c.logErrorf("Failed to write coalesced metrics to %s, dropping them: %v", bucket, err)
+		c.metrics.drop(dropCoalesceFailure, len(metrics))
+		return err
+	}
+	return nil
+}
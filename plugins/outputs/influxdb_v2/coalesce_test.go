@@ -0,0 +1,264 @@
+package influxdb_v2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/testutil"
+)
+
+func TestCoalesce(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			mu.Lock()
+			bodies = append(bodies, r.URL.Query().Get("bucket")+": "+string(body))
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	)
+	defer ts.Close()
+	requests := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), bodies...)
+	}
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:            genURL(ts.URL),
+		Bucket:         "telegraf",
+		BucketTag:      "bucket",
+		CoalesceWindow: 100 * time.Millisecond,
+		CoalesceBytes:  64,
+		Log:            testutil.Logger{},
+	})
+	require.NoError(t, err)
+
+	metric := func(bucket string, value int) []telegraf.Metric {
+		return []telegraf.Metric{
+			testutil.MustMetric("cpu", map[string]string{"bucket": bucket}, map[string]interface{}{"value": value}, time.Unix(0, 0)),
+		}
+	}
+
+	// Small batches are collected per bucket until the window expires
+	require.NoError(t, c.Write(context.Background(), metric("a", 1)))
+	require.NoError(t, c.Write(context.Background(), metric("b", 2)))
+	require.NoError(t, c.Write(context.Background(), metric("a", 3)))
+	require.Empty(t, requests())
+	require.Eventually(t, func() bool { return len(requests()) == 2 }, time.Second, 10*time.Millisecond)
+	require.ElementsMatch(t, []string{
+		"a: cpu,bucket=a value=1i 0\ncpu,bucket=a value=3i 0\n",
+		"b: cpu,bucket=b value=2i 0\n",
+	}, requests())
+
+	// Reaching the size limit writes the collected metrics right away
+	for i := 0; i < 3; i++ {
+		require.NoError(t, c.Write(context.Background(), metric("a", i)))
+	}
+	require.Len(t, requests(), 3)
+	require.Equal(t, 3, strings.Count(requests()[2], "\n"))
+
+	// Close writes the remaining metrics
+	require.NoError(t, c.Write(context.Background(), metric("b", 4)))
+	c.Close()
+	require.Len(t, requests(), 4)
+	require.Equal(t, "b: cpu,bucket=b value=4i 0\n", requests()[3])
+}
+
+func TestCoalesceLimits(t *testing.T) {
+	var written [][]telegraf.Metric
+	var pending pendingQueue
+	c := newCoalescer(time.Hour, 100, &pending, func(_ context.Context, _ string, metrics []telegraf.Metric) error {
+		written = append(written, metrics)
+		return nil
+	})
+	m := testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, time.Unix(0, 0))
+	add := func(bucket string, metrics []telegraf.Metric, size int64) []telegraf.Metric {
+		metrics, ids := c.add(bucket, metrics, size)
+		pending.done(ids...)
+		return metrics
+	}
+
+	// Batches exceeding the limit on their own are not collected
+	require.Len(t, add("large", []telegraf.Metric{m}, 100), 1)
+
+	// Collected metrics are prepended to a batch exceeding the limit
+	require.Empty(t, add("a", []telegraf.Metric{m}, 10))
+	require.Len(t, add("a", []telegraf.Metric{m, m}, 100), 3)
+
+	// The number of buckets with collected metrics is bounded
+	for i := 0; i < maxCoalescedBuckets; i++ {
+		require.Empty(t, add(strings.Repeat("x", i+1), []telegraf.Metric{m}, 10))
+	}
+	require.Len(t, add("overflow", []telegraf.Metric{m}, 10), 1)
+	require.Equal(t, maxCoalescedBuckets, pending.stats(time.Now()).Metrics)
+
+	require.NoError(t, c.flush(context.Background()))
+	require.Len(t, written, maxCoalescedBuckets)
+	require.Zero(t, pending.stats(time.Now()).Metrics)
+}
+
+func TestCoalescePending(t *testing.T) {
+	status := http.StatusNoContent
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.ReadAll(r.Body)
+			w.WriteHeader(status)
+		}),
+	)
+	defer ts.Close()
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:            genURL(ts.URL),
+		Bucket:         "telegraf",
+		CoalesceWindow: time.Hour,
+		CoalesceBytes:  1024,
+		Log:            testutil.Logger{},
+	})
+	require.NoError(t, err)
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+	}
+
+	// Collected metrics are pending until written
+	require.NoError(t, c.Write(context.Background(), metrics))
+	require.NoError(t, c.Write(context.Background(), metrics))
+	require.Equal(t, 2, c.QueueDepth().Metrics)
+	require.NoError(t, c.Flush(context.Background()))
+	require.Zero(t, c.QueueDepth().Metrics)
+
+	// Dropping failed writes of collected metrics clears them as well, and
+	// the failure is returned by Flush
+	status = http.StatusInternalServerError
+	require.NoError(t, c.Write(context.Background(), metrics))
+	require.Equal(t, 1, c.QueueDepth().Metrics)
+	require.ErrorContains(t, c.Flush(context.Background()), "500")
+	require.Zero(t, c.QueueDepth().Metrics)
+
+	// The context is passed to the write
+	require.NoError(t, c.Write(context.Background(), metrics))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, c.Flush(ctx), context.Canceled)
+}
+
+func TestFlush(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			mu.Lock()
+			bodies = append(bodies, r.URL.Query().Get("bucket")+": "+string(body))
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	)
+	defer ts.Close()
+	requests := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), bodies...)
+	}
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:            genURL(ts.URL),
+		Bucket:         "telegraf",
+		BackfillAge:    time.Hour,
+		BackfillBucket: "archive",
+		CoalesceWindow: time.Hour,
+		CoalesceBytes:  1024,
+		Log:            testutil.Logger{},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, now),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 2}, old),
+	}
+
+	// Both the client and the backfill client collect the metrics
+	require.NoError(t, c.Write(context.Background(), metrics))
+	require.Empty(t, requests())
+	require.Equal(t, 1, c.QueueDepth().Metrics)
+	require.Equal(t, 1, c.backfill.QueueDepth().Metrics)
+
+	// Flush writes the collected metrics of both
+	require.NoError(t, c.Flush(context.Background()))
+	require.ElementsMatch(t, []string{
+		fmt.Sprintf("telegraf: cpu value=1i %d\n", now.UnixNano()),
+		fmt.Sprintf("archive: cpu value=2i %d\n", old.UnixNano()),
+	}, requests())
+	require.Zero(t, c.QueueDepth().Metrics)
+	require.Zero(t, c.backfill.QueueDepth().Metrics)
+}
+
+func TestCoalesceConcurrentRetries(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.ReadAll(r.Body)
+			if atomic.AddInt32(&requests, 1)%2 == 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	)
+	defer ts.Close()
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:                genURL(ts.URL),
+		Bucket:             "telegraf",
+		BucketTag:          "bucket",
+		CoalesceWindow:     time.Millisecond,
+		CoalesceBytes:      1024,
+		MaxRetryWait:       time.Millisecond,
+		RetryProbeFraction: 0.5,
+		RetryAttemptTag:    "attempt",
+		Log:                testutil.Logger{},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Expiring windows are written in the background while writing and
+	// flushing, all of them sharing the retry state
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				metrics := []telegraf.Metric{
+					testutil.MustMetric("cpu", map[string]string{"bucket": fmt.Sprintf("b%d", j%3)},
+						map[string]interface{}{"value": i}, time.Unix(0, 0)),
+				}
+				_ = c.Write(context.Background(), metrics)
+				if j%10 == 0 {
+					_ = c.Flush(context.Background())
+				}
+				time.Sleep(100 * time.Microsecond)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,98 @@
+package influxdb_v2
+
+import (
+	"context"
+	"sync"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/plugins/serializers"
+)
+
+// lockedSerializer serializes the metrics of concurrent batches one at a
+// time, as serializers keep internal buffers.
+type lockedSerializer struct {
+	sync.Mutex
+	serializer serializers.Serializer
+}
+
+func (s *lockedSerializer) Serialize(metric telegraf.Metric) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.serializer.Serialize(metric)
+}
+
+func (s *lockedSerializer) SerializeBatch(metrics []telegraf.Metric) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.serializer.SerializeBatch(metrics)
+}
+
+// writeBuckets writes the batches of the buckets in the given order, up to
+// MaxConcurrentBatches at a time. The errors of all buckets are returned,
+// unless failing fast on an authentication error.
+func (c *httpClient) writeBuckets(ctx context.Context, buckets []string, batches map[string][]telegraf.Metric) error {
+	if c.MaxConcurrentBatches <= 1 {
+		var errs []error
+		for _, bucket := range buckets {
+			err := c.writeBatches(ctx, bucket, batches[bucket])
+			if err != nil {
+				if c.FailFastOnAuthError && isAuthError(err) {
+					return err
+				}
+
+				errs = append(errs, err)
+			}
+		}
+		return joinErrors(errs)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Keep the errors in the order of the buckets
+	errs := make([]error, len(buckets))
+	var authErr error
+	var authOnce sync.Once
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, c.MaxConcurrentBatches)
+	for i, bucket := range buckets {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			errs[i] = ctx.Err()
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, bucket string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			err := c.writeBatches(ctx, bucket, batches[bucket])
+			if err != nil && c.FailFastOnAuthError && isAuthError(err) {
+				authOnce.Do(func() {
+					authErr = err
+					cancel()
+				})
+			}
+			errs[i] = err
+		}(i, bucket)
+	}
+	wg.Wait()
+
+	if authErr != nil {
+		return authErr
+	}
+
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	return joinErrors(failed)
+}
@@ -0,0 +1,106 @@
+package influxdb_v2
+
+import (
+	"crypto/sha256"
+	"sync"
+
+	"github.com/influxdata/telegraf"
+)
+
+// batchCall is a write of a batch in progress.
+type batchCall struct {
+	done chan struct{}
+	err  error
+}
+
+// batchDeduplicator coalesces writes of identical batches. A batch
+// submitted again while a previous write of it is still in progress waits
+// for the result of that write instead of being sent twice. As the agent
+// re-sends all metrics of a failed write, batches written successfully are
+// remembered until a write succeeds completely, so retries skip them. At
+// most limit batches are tracked each, further ones are written without
+// deduplication.
+type batchDeduplicator struct {
+	limit int
+
+	sync.Mutex
+	calls   map[[sha256.Size]byte]*batchCall
+	written map[[sha256.Size]byte]bool
+}
+
+// do calls write unless the batch with the same key was written since the
+// last reset or a write of it is in progress, in which case its result is
+// returned once done.
+func (d *batchDeduplicator) do(key [sha256.Size]byte, write func() error) error {
+	d.Lock()
+	if d.written[key] {
+		d.Unlock()
+		return nil
+	}
+	if call, ok := d.calls[key]; ok {
+		d.Unlock()
+		<-call.done
+		return call.err
+	}
+	if len(d.calls) >= d.limit {
+		d.Unlock()
+		return write()
+	}
+	if d.calls == nil {
+		d.calls = make(map[[sha256.Size]byte]*batchCall)
+	}
+	call := &batchCall{done: make(chan struct{})}
+	d.calls[key] = call
+	d.Unlock()
+
+	call.err = write()
+
+	d.Lock()
+	delete(d.calls, key)
+	if call.err == nil && len(d.written) < d.limit {
+		if d.written == nil {
+			d.written = make(map[[sha256.Size]byte]bool)
+		}
+		d.written[key] = true
+	}
+	d.Unlock()
+	close(call.done)
+
+	return call.err
+}
+
+// reset forgets the written batches once the agent will not re-send them.
+func (d *batchDeduplicator) reset() {
+	d.Lock()
+	defer d.Unlock()
+
+	d.written = nil
+}
+
+// payloadKey identifies a batch by its bucket and serialized body.
+func payloadKey(bucket string, payload []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte(bucket))
+	h.Write([]byte{0})
+	h.Write(payload)
+
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// batchKey identifies a batch by its bucket and serialized metrics.
+func (c *httpClient) batchKey(bucket string, metrics []telegraf.Metric) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte(bucket))
+	h.Write([]byte{0})
+	for _, metric := range metrics {
+		if octets, err := c.serializer.Serialize(metric); err == nil {
+			h.Write(octets)
+		}
+	}
+
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
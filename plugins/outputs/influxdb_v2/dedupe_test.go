@@ -0,0 +1,118 @@
+package influxdb_v2
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/testutil"
+)
+
+func TestBatchDeduplicator(t *testing.T) {
+	d := &batchDeduplicator{limit: 1}
+	key := sha256.Sum256([]byte("batch"))
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	first := make(chan error)
+	go func() {
+		first <- d.do(key, func() error {
+			close(started)
+			<-release
+			return errors.New("failed")
+		})
+	}()
+	<-started
+
+	// An identical batch waits for the write in progress
+	second := make(chan error)
+	go func() {
+		second <- d.do(key, func() error {
+			return errors.New("written twice")
+		})
+	}()
+	select {
+	case err := <-second:
+		t.Fatalf("identical batch not coalesced: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Batches beyond the tracking limit are written directly
+	other := sha256.Sum256([]byte("other"))
+	var written bool
+	require.NoError(t, d.do(other, func() error {
+		written = true
+		return nil
+	}))
+	require.True(t, written)
+
+	close(release)
+	require.EqualError(t, <-first, "failed")
+	require.EqualError(t, <-second, "failed")
+	require.Empty(t, d.calls)
+	require.Empty(t, d.written)
+}
+
+func TestWriteDeduplicateRetries(t *testing.T) {
+	var mu sync.Mutex
+	writes := make(map[string]int)
+	failing := true
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.ReadAll(r.Body)
+			bucket := r.URL.Query().Get("bucket")
+
+			mu.Lock()
+			defer mu.Unlock()
+			writes[bucket]++
+			if bucket == "b" && failing {
+				failing = false
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	)
+	defer ts.Close()
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:                genURL(ts.URL),
+		Bucket:             "telegraf",
+		BucketTag:          "bucket",
+		DeduplicateBatches: true,
+		Log:                testutil.Logger{},
+	})
+	require.NoError(t, err)
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{"bucket": "a"}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+		testutil.MustMetric("cpu", map[string]string{"bucket": "b"}, map[string]interface{}{"value": 2}, time.Unix(0, 0)),
+	}
+	count := func(bucket string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return writes[bucket]
+	}
+
+	// Re-sending the batch after bucket b failed skips bucket a
+	require.Error(t, c.Write(context.Background(), metrics))
+	require.Eventually(t, func() bool {
+		return c.Write(context.Background(), metrics) == nil
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, 1, count("a"))
+	require.Equal(t, 2, count("b"))
+
+	// Once written completely, the batch is sent again
+	require.NoError(t, c.Write(context.Background(), metrics))
+	require.Equal(t, 2, count("a"))
+	require.Equal(t, 3, count("b"))
+}
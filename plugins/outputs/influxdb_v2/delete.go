@@ -0,0 +1,113 @@
+package influxdb_v2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
+)
+
+// checkDeleteConfig ensures deleting after writes is configured explicitly.
+func checkDeleteConfig(config *HTTPConfig) error {
+	if len(config.DeleteBuckets) == 0 {
+		if config.DeletePredicate != "" || config.DeleteStart != 0 || config.DeleteStop != 0 {
+			return errors.New("deleting after writes requires the buckets to delete from")
+		}
+		return nil
+	}
+	if config.DeletePredicate == "" {
+		return errors.New("deleting after writes requires a predicate")
+	}
+	// A range ending now would include the data just written
+	if config.DeleteStop <= 0 || config.DeleteStart <= config.DeleteStop {
+		return fmt.Errorf("invalid delete range from %s to %s ago", config.DeleteStart, config.DeleteStop)
+	}
+	return nil
+}
+
+// deleteStale deletes the configured range of stale data from the bucket
+// after a successful write request of the given metrics to it, if configured
+// for the bucket. The delete is skipped if any of the metrics just written
+// falls into the range.
+func (c *httpClient) deleteStale(ctx context.Context, bucket string, metrics []telegraf.Metric) {
+	if !c.deleteBuckets[bucket] {
+		return
+	}
+
+	now := time.Now()
+	start, stop := now.Add(-c.DeleteStart), now.Add(-c.DeleteStop)
+	for _, m := range metrics {
+		if t := m.Time(); !t.Before(start) && !t.After(stop) {
+			c.logWarnf("Skipped deleting stale data from %s, the metrics just written are in the range to delete", bucket)
+			return
+		}
+	}
+
+	err := c.deleteRange(ctx, bucket, start, stop)
+	if err != nil {
+		c.metrics.deleteFailures.Inc()
+		c.logErrorf("Deleting stale data from %s failed, the write succeeded: %v", bucket, err)
+		return
+	}
+	c.log.Debugf("Deleted data matching %q from %s", c.DeletePredicate, bucket)
+}
+
+// deleteRange deletes the data matching the delete predicate within the
+// given time range from the bucket.
+func (c *httpClient) deleteRange(ctx context.Context, bucket string, start, stop time.Time) error {
+	params := url.Values{}
+	params.Set("bucket", bucket)
+	if c.OrganizationID != "" {
+		params.Set("orgID", c.OrganizationID)
+	} else {
+		params.Set("org", c.Organization)
+	}
+	loc, err := makeAPIURL(*c.url, "/api/v2/delete", params)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"start":     start.UTC().Format(time.RFC3339Nano),
+		"stop":      stop.UTC().Format(time.RFC3339Nano),
+		"predicate": c.DeletePredicate,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", loc, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.addHeaders(req)
+	if auth, ok := c.bucketAuth[bucket]; ok {
+		req.Header.Set("Authorization", auth)
+	}
+	c.encodeQuerySpaces(req)
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		internal.OnClientError(c.client, err)
+		return err
+	}
+	c.limitBody(resp)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return &APIError{
+			StatusCode:  resp.StatusCode,
+			Title:       resp.Status,
+			Description: errorDescription(resp),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package influxdb_v2
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/testutil"
+)
+
+func TestDeleteStale(t *testing.T) {
+	var deletes []map[string]string
+	var buckets []string
+	writeStatus := http.StatusNoContent
+	deleteStatus := http.StatusNoContent
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/api/v2/write":
+				_, _ = io.ReadAll(r.Body)
+				w.WriteHeader(writeStatus)
+			case "/api/v2/delete":
+				require.Equal(t, "influx", r.URL.Query().Get("org"))
+				var body map[string]string
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+				deletes = append(deletes, body)
+				buckets = append(buckets, r.URL.Query().Get("bucket"))
+				w.WriteHeader(deleteStatus)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:             genURL(ts.URL),
+		Organization:    "influx",
+		Bucket:          "telegraf",
+		BucketTag:       "bucket",
+		DeleteBuckets:   []string{"aggregates"},
+		DeletePredicate: `version="1"`,
+		DeleteStart:     48 * time.Hour,
+		DeleteStop:      24 * time.Hour,
+		Log:             testutil.Logger{},
+	})
+	require.NoError(t, err)
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+		testutil.MustMetric("agg", map[string]string{"bucket": "aggregates"}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+	}
+	now := time.Now()
+	require.NoError(t, c.Write(context.Background(), metrics))
+	require.Equal(t, []string{"aggregates"}, buckets)
+	require.Equal(t, `version="1"`, deletes[0]["predicate"])
+	start, err := time.Parse(time.RFC3339Nano, deletes[0]["start"])
+	require.NoError(t, err)
+	require.WithinDuration(t, now.Add(-48*time.Hour), start, time.Second)
+	stop, err := time.Parse(time.RFC3339Nano, deletes[0]["stop"])
+	require.NoError(t, err)
+	require.WithinDuration(t, now.Add(-24*time.Hour), stop, time.Second)
+
+	// Failed deletes do not fail the write
+	deleteStatus = http.StatusForbidden
+	require.NoError(t, c.Write(context.Background(), metrics))
+	require.Len(t, deletes, 2)
+
+	// Nothing is deleted if the metrics just written are within the range
+	deleteStatus = http.StatusNoContent
+	recent := []telegraf.Metric{
+		testutil.MustMetric("agg", map[string]string{"bucket": "aggregates"}, map[string]interface{}{"value": 1}, now.Add(-36*time.Hour)),
+	}
+	require.NoError(t, c.Write(context.Background(), recent))
+	require.Len(t, deletes, 2)
+
+	// Nothing is deleted if the write failed or was dropped
+	writeStatus = http.StatusBadRequest
+	require.NoError(t, c.Write(context.Background(), metrics))
+	require.Len(t, deletes, 2)
+}
+
+func TestDeleteStaleBucketToken(t *testing.T) {
+	var deletes int
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			expected := "Token default"
+			if r.URL.Query().Get("bucket") == "aggregates" {
+				expected = "Token tenant"
+			}
+			if r.Header.Get("Authorization") != expected {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			switch r.URL.Path {
+			case "/api/v2/write":
+				_, _ = io.ReadAll(r.Body)
+			case "/api/v2/delete":
+				deletes++
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	)
+	defer ts.Close()
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:             genURL(ts.URL),
+		Token:           "default",
+		Organization:    "influx",
+		Bucket:          "telegraf",
+		BucketTag:       "bucket",
+		BucketTokens:    map[string]string{"aggregates": "tenant"},
+		DeleteBuckets:   []string{"aggregates"},
+		DeletePredicate: `version="1"`,
+		DeleteStart:     48 * time.Hour,
+		DeleteStop:      24 * time.Hour,
+		Log:             testutil.Logger{},
+	})
+	require.NoError(t, err)
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("agg", map[string]string{"bucket": "aggregates"}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+	}
+	require.NoError(t, c.Write(context.Background(), metrics))
+	require.Equal(t, 1, deletes)
+}
+
+func TestCheckDeleteConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config HTTPConfig
+		err    string
+	}{
+		{
+			name: "disabled",
+		},
+		{
+			name:   "missing buckets",
+			config: HTTPConfig{DeletePredicate: `version="1"`, DeleteStart: time.Hour},
+			err:    "requires the buckets",
+		},
+		{
+			name:   "missing predicate",
+			config: HTTPConfig{DeleteBuckets: []string{"a"}, DeleteStart: time.Hour},
+			err:    "requires a predicate",
+		},
+		{
+			name:   "missing range",
+			config: HTTPConfig{DeleteBuckets: []string{"a"}, DeletePredicate: `version="1"`},
+			err:    "invalid delete range",
+		},
+		{
+			name:   "range ending now",
+			config: HTTPConfig{DeleteBuckets: []string{"a"}, DeletePredicate: `version="1"`, DeleteStart: time.Hour},
+			err:    "invalid delete range",
+		},
+		{
+			name:   "inverted range",
+			config: HTTPConfig{DeleteBuckets: []string{"a"}, DeletePredicate: `version="1"`, DeleteStart: time.Hour, DeleteStop: 2 * time.Hour},
+			err:    "invalid delete range",
+		},
+		{
+			name:   "valid",
+			config: HTTPConfig{DeleteBuckets: []string{"a"}, DeletePredicate: `version="1"`, DeleteStart: 2 * time.Hour, DeleteStop: time.Hour},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDeleteConfig(&tt.config)
+			if tt.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package influxdb_v2
+
+import (
+	"net"
+	"time"
+)
+
+// happyEyeballsDelay is the head start of the preferred address family
+// before connecting over the other one in parallel, as recommended by
+// RFC 8305.
+const happyEyeballsDelay = 50 * time.Millisecond
+
+// happyEyeballsDialer returns a dialer connecting over IPv4 and IPv6 in
+// parallel once the preferred address family had a short head start. The
+// default delay of net.Dialer is 300ms, which stalls every new connection on
+// dual-stack hosts with broken IPv6 routing.
+func happyEyeballsDialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout:       timeout,
+		FallbackDelay: happyEyeballsDelay,
+	}
+}
@@ -0,0 +1,62 @@
+package influxdb_v2
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/testutil"
+)
+
+func TestHappyEyeballsDialer(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+
+	dialer := happyEyeballsDialer(5 * time.Second)
+	require.Equal(t, 5*time.Second, dialer.Timeout)
+	require.Equal(t, happyEyeballsDelay, dialer.FallbackDelay)
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", net.JoinHostPort("127.0.0.1", port))
+	require.NoError(t, err)
+	require.Equal(t, listener.Addr().String(), conn.RemoteAddr().String())
+	require.NoError(t, conn.Close())
+
+	// The error of the address family tried is returned
+	require.NoError(t, listener.Close())
+	_, err = dialer.DialContext(context.Background(), "tcp", net.JoinHostPort("127.0.0.1", port))
+	require.ErrorContains(t, err, "refused")
+}
+
+func TestWriteHappyEyeballs(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	client, err := NewHTTPClient(&HTTPConfig{
+		URL:           genURL(ts.URL),
+		Bucket:        "telegraf",
+		HappyEyeballs: true,
+	})
+	require.NoError(t, err)
+	defer client.Close()
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{},
+			map[string]interface{}{"value": 42.0}, time.Unix(0, 0)),
+	}
+	require.NoError(t, client.Write(context.Background(), metrics))
+	require.Equal(t, 1, requests)
+}
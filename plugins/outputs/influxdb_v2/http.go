@@ -1,22 +1,44 @@
 package influxdb_v2
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"math/rand"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+	"github.com/influxdata/influxdb-observability/influx2otel"
+	"golang.org/x/net/http2"
+	"golang.org/x/oauth2"
 
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/filter"
 	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/influxdata/telegraf/plugins/common/oauth"
+	"github.com/influxdata/telegraf/plugins/serializers"
 	"github.com/influxdata/telegraf/plugins/serializers/influx"
 )
 
@@ -33,12 +55,116 @@ func (e APIError) Error() string {
 	return e.Title
 }
 
+// AuthenticationError is returned if the server rejected the credentials
+// of a write with 401 or 403. Retrying with the same credentials will fail
+// again.
+type AuthenticationError struct {
+	APIError
+}
+
+func (e *AuthenticationError) Unwrap() error {
+	return &e.APIError
+}
+
 const (
+	defaultTokenPrefix              = "Token"
 	defaultRequestTimeout           = time.Second * 5
 	defaultMaxWaitSeconds           = 60
 	defaultMaxWaitRetryAfterSeconds = 10 * 60
+	defaultMaxResponseBodySize      = 4 * 1024 * 1024
+	defaultMaintenanceWait          = 5 * time.Minute
+	defaultMaxTrackedBatches        = 100
+	defaultWritePath                = "/api/v2/write"
+	defaultOrgsPath                 = "/api/v2/orgs"
 )
 
+// LineProtocolSink receives serialized line protocol in place of sending it
+// to the InfluxDB HTTP API, e.g. to publish it to a message queue. The bucket
+// is the one the batch would have been written to, e.g. to select a topic.
+type LineProtocolSink interface {
+	Write(ctx context.Context, bucket string, body []byte) error
+}
+
+// BodyError is returned if producing the request body failed, e.g. due to a
+// compression error. The batch was not delivered.
+type BodyError struct {
+	Err error
+}
+
+func (e *BodyError) Error() string {
+	return fmt.Sprintf("creating request body failed: %v", e.Err)
+}
+
+func (e *BodyError) Unwrap() error {
+	return e.Err
+}
+
+// RetryError is returned if a write is held back because the server asked
+// to back off. The batch was not sent.
+type RetryError struct {
+	retryTime time.Time
+}
+
+func (e *RetryError) Error() string {
+	return "retry time has not elapsed"
+}
+
+// RetryAfter returns the time at which writes are attempted again.
+func (e *RetryError) RetryAfter() time.Time {
+	return e.retryTime
+}
+
+// bodyReader records errors occurring while reading the request body to
+// distinguish them from network errors. If a tap is set, the bytes read are
+// copied to it; a failing tap is not written to anymore but never affects
+// the body.
+type bodyReader struct {
+	io.ReadCloser
+	tap io.Writer
+
+	sync.Mutex
+	err    error
+	tapErr error
+	read   int64
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(&r.read, int64(n))
+	if r.tap != nil && n > 0 {
+		if _, terr := r.tap.Write(p[:n]); terr != nil {
+			r.Lock()
+			r.tapErr = terr
+			r.Unlock()
+			r.tap = nil
+		}
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		r.Lock()
+		r.err = err
+		r.Unlock()
+	}
+	return n, err
+}
+
+func (r *bodyReader) Err() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.err
+}
+
+// TapErr returns the error writing to the tap, if any.
+func (r *bodyReader) TapErr() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.tapErr
+}
+
+// BytesRead returns the number of bytes read from the body so far.
+func (r *bodyReader) BytesRead() int64 {
+	return atomic.LoadInt64(&r.read)
+}
+
 type HTTPConfig struct {
 	URL              *url.URL
 	Token            string
@@ -52,6 +178,415 @@ type HTTPConfig struct {
 	UserAgent        string
 	ContentEncoding  string
 	TLSConfig        *tls.Config
+	MirrorURL        *url.URL
+	MirrorToken      string
+
+	ClampFutureTimestamps    bool
+	FutureTimestampTolerance time.Duration
+
+	// RoundTimestamps rounds the timestamp of all metrics to a multiple of
+	// the given interval. It is applied after clamping future timestamps, so
+	// clamped metrics are aligned as well.
+	RoundTimestamps time.Duration
+
+	// NudgeDuplicateTimestamps shifts the timestamp of metrics colliding with
+	// an earlier metric of the same series in the batch by
+	// DuplicateTimestampOffset (default 1ns), so the server does not
+	// overwrite the earlier point. It is applied after rounding timestamps.
+	NudgeDuplicateTimestamps bool
+	DuplicateTimestampOffset time.Duration
+
+	// TokenPrefix is the scheme put in front of the token in the
+	// Authorization header, defaults to "Token". If OmitTokenPrefix is set,
+	// the token is sent verbatim.
+	TokenPrefix     string
+	OmitTokenPrefix bool
+
+	// MaxBatchBytes limits the serialized size of a single write request,
+	// larger batches are split into multiple requests. Zero means unlimited.
+	MaxBatchBytes int64
+
+	// Sink, if set, receives the uncompressed line protocol of every batch
+	// along with its target bucket instead of it being written via HTTP.
+	// Rate limits, the in-flight limit and the hooks apply to sink writes as
+	// well, the hooks reporting no status code.
+	Sink LineProtocolSink
+
+	// MaxRetryWait caps the time writes are held back after a retryable
+	// failure. Once elapsed, the next write acts as a probe of the server.
+	// Zero means no cap beyond the built-in limits.
+	MaxRetryWait time.Duration
+
+	// BrotliQuality sets the compression quality between 1 and 11 used for
+	// the "br" content encoding. Zero selects the default quality.
+	BrotliQuality int
+
+	// CompressionLevel sets the level used for the "gzip" content encoding
+	// following compress/gzip from 1 (fastest) to 9 (best compression), -1
+	// for the default level or -2 for Huffman encoding only. Zero selects the
+	// default level, use the "identity" content encoding to send the body
+	// uncompressed.
+	CompressionLevel int
+
+	// WrapTransport, if set, is called with the transport built from the
+	// URL, TLS and proxy settings and the returned RoundTripper is used for
+	// all requests, e.g. to add instrumentation.
+	WrapTransport func(http.RoundTripper) http.RoundTripper
+
+	// LogSuppressionWindow suppresses identical consecutive write errors
+	// within the window, logging a summary of the repetitions instead.
+	// Zero logs every error.
+	LogSuppressionWindow time.Duration
+
+	// RetryAfterJitter adds a random delay of up to the given duration on
+	// top of the wait requested by the server via the Retry-After header.
+	RetryAfterJitter time.Duration
+
+	// HostnameTag, if set, adds the hostname of the machine as the given tag
+	// to metrics not having this tag yet.
+	HostnameTag string
+
+	// ServerDryRun asks the server to validate the line protocol without
+	// persisting it. Servers not supporting dry-runs ignore the parameter
+	// and store the data!
+	ServerDryRun bool
+
+	// HeartbeatMeasurement, if set, sends a metric with this name to the
+	// default bucket for writes without any metrics to send. The heartbeat
+	// bypasses the bucket routing and requires the default bucket.
+	HeartbeatMeasurement string
+
+	// InvalidBucketPolicy selects how bucket names taken from the bucket tag
+	// containing characters other than letters, digits, ".", "-" and "_" are
+	// handled: "keep" them as is (default), "drop" the metric or "sanitize"
+	// the name by replacing invalid characters with "_".
+	InvalidBucketPolicy string
+
+	// ReservedBucketPolicy selects how bucket names taken from the bucket
+	// tag starting with "_", reserved for system buckets such as
+	// "_monitoring", are handled: "keep" them as is (default), write the
+	// metric to the "default" bucket or "drop" the metric.
+	ReservedBucketPolicy string
+
+	// QuerySpaceEncoding selects how spaces in query parameters such as the
+	// organization are encoded, either as "plus" (default) or "percent".
+	QuerySpaceEncoding string
+
+	// ExcludeFields removes the fields with keys matching any of the glob
+	// patterns before serialization.
+	ExcludeFields []string
+
+	// MaxInFlightBytes limits the uncompressed size of all requests sent
+	// concurrently, writes block until enough bytes are released. Zero means
+	// unlimited.
+	MaxInFlightBytes int64
+
+	// WriteFormat selects the format of the written metrics, either
+	// "influx" for line protocol written to the InfluxDB API (default) or
+	// "otlp" for OpenTelemetry metrics in protobuf encoding sent to the
+	// "/v1/metrics" path of the URL. The bucket is not used for "otlp".
+	WriteFormat string
+
+	// PriorityHeader is the name of the header carrying the priority of a
+	// write, e.g. for gateways shedding low-priority writes under load. The
+	// header is only sent if a priority is set for the bucket and has no
+	// effect unless the server understands it.
+	PriorityHeader string
+	// Priority is the value of the priority header for buckets not listed in
+	// BucketPriorities.
+	Priority string
+	// BucketPriorities overrides the priority per bucket.
+	BucketPriorities map[string]string
+
+	// Precision is sent as the precision of the written timestamps. The
+	// serializer always writes nanosecond timestamps, so only "ns" is
+	// accepted; an empty value omits the parameter and relies on the
+	// server's default of nanoseconds.
+	Precision string
+
+	// DisableRetries returns an error immediately when the server asks to
+	// back off instead of waiting before the next write. The client then
+	// never resends on its own, the agent decides what happens with the
+	// metrics.
+	DisableRetries bool
+
+	// DropUntagged drops metrics without the bucket tag instead of writing
+	// them to the default bucket. Without it a default bucket is required
+	// when using a bucket tag.
+	DropUntagged bool
+
+	// FailFastOnAuthError stops writing to the remaining buckets as soon as
+	// the server rejects the credentials. Otherwise all buckets are written
+	// and the errors are combined.
+	FailFastOnAuthError bool
+
+	// MaxResponseBodySize limits the number of bytes read from response
+	// bodies, larger bodies are truncated. Defaults to 4 MiB.
+	MaxResponseBodySize int64
+
+	// MeasurementBuckets maps measurement names to buckets. Keys may be glob
+	// patterns, exact names take precedence over patterns which are tried in
+	// lexical order. The bucket tag takes precedence over this mapping, the
+	// default bucket is used for unmatched measurements.
+	MeasurementBuckets map[string]string
+
+	// OAuth2 obtains bearer tokens via the client-credentials flow and
+	// refreshes them automatically, e.g. for gateways protected by OAuth2.
+	// It cannot be combined with a static token.
+	OAuth2 oauth.OAuth2Config
+
+	// AckTimeout waits up to the given duration for writes accepted with 202
+	// to be confirmed by polling the status URL announced in the Location
+	// header. Polling starts after AckInterval (default 500ms) and backs off
+	// up to 5s. Writes not confirmed in time fail, so the agent retries them.
+	// Zero treats 202 as delivered.
+	AckTimeout  time.Duration
+	AckInterval time.Duration
+
+	// AdaptiveCompression toggles the content encoding based on the moving
+	// average of the write latency: compression is skipped once the average
+	// drops below CompressionLatencyLow, as the network is not the
+	// bottleneck, and used again once it exceeds CompressionLatencyHigh.
+	// Writes start compressed with the configured content encoding.
+	AdaptiveCompression    bool
+	CompressionLatencyLow  time.Duration
+	CompressionLatencyHigh time.Duration
+
+	// RetrySizeThreshold lengthens the wait after a server asked to back off
+	// for batches larger than the threshold. The wait is multiplied by the
+	// ratio of the serialized batch size to the threshold, limited to the
+	// maximum backoff of 60s or MaxRetryWait. Zero disables the scaling.
+	RetrySizeThreshold int64
+
+	// OnDelivery, if set, is called with a receipt exactly once for every
+	// request sent to write a batch, whether it succeeded or not.
+	OnDelivery func(Receipt)
+
+	// OnWrite, if set, is called for every request sent to write a batch,
+	// whether it succeeded or not, e.g. to track payload sizes and latency.
+	OnWrite func(WriteStats)
+
+	// Tap, if set, receives a copy of the request bodies exactly as sent,
+	// i.e. after compression, e.g. for replaying or auditing the traffic.
+	// Errors writing to the tap are logged and do not fail the write.
+	Tap io.Writer
+
+	// OrganizationID references the organization by its ID instead of its
+	// name, avoiding issues with names not surviving routing. This cannot be
+	// combined with Organization.
+	OrganizationID string
+
+	// SoftErrorPolicy sets the handling of the X-Influx-Error header on
+	// successful writes, reported by some servers for partially accepted
+	// batches. Available values are "ignore" (default) and "warn", the
+	// latter logging the error. The write is considered delivered either way.
+	SoftErrorPolicy string
+
+	// FieldBuckets maps field names to buckets, metrics having one of the
+	// fields are written to its bucket. If a metric has several of the
+	// fields, the lexically first one is used. The bucket tag takes
+	// precedence over this mapping, which in turn takes precedence over
+	// MeasurementBuckets.
+	FieldBuckets map[string]string
+
+	// MaxIdleConnAge closes connections which were idle for longer than the
+	// given duration instead of reusing them, e.g. as they might have been
+	// dropped silently by firewalls or NAT in between. Zero keeps idle
+	// connections open. Independent of this setting, writes failing as a
+	// reused connection was closed are resent once on a new connection.
+	MaxIdleConnAge time.Duration
+
+	// SequenceHeader, if set, sends a per-client sequence number increasing
+	// with every batch in the given header, e.g. to detect lost or reordered
+	// batches downstream. Failed batches keep their number when resent
+	// unchanged.
+	SequenceHeader string
+
+	// LatencyBuckets are the upper bounds of the histogram buckets for
+	// tracking write request latencies per bucket. No latencies are tracked
+	// if empty.
+	LatencyBuckets []time.Duration
+
+	// RetryStateFile, if set, persists the wait after the server asked to
+	// back off in the given file, so a restart during the wait does not
+	// resume writing right away. States whose wait elapsed are ignored. The
+	// file may be shared by the clients of all URLs.
+	RetryStateFile string
+
+	// DropOutOfRetention drops metrics older than the retention period of
+	// their bucket before writing, as the server rejects the whole batch
+	// otherwise. The retention is looked up once per bucket, which requires
+	// read access to the organization and bucket. Failed lookups are retried
+	// after a minute, writes are not checked until then.
+	DropOutOfRetention bool
+
+	// InvalidUTF8Policy sets the handling of metrics with invalid UTF-8 in
+	// their name, tags or fields, which the server rejects along with the
+	// whole batch. Available values are "keep" (default), "scrub" to replace
+	// invalid bytes with the Unicode replacement character and "drop" to
+	// drop the metric.
+	InvalidUTF8Policy string
+
+	// CreateOrganization creates the organization if looking up its ID finds
+	// no organization of that name. This requires a token allowed to create
+	// organizations.
+	CreateOrganization bool
+
+	// MaxRequestsPerSecond and MaxBytesPerSecond delay write requests to
+	// stay below the given rates, allowing bursts of up to one second. The
+	// byte rate applies to the uncompressed size. Zero means unlimited.
+	MaxRequestsPerSecond float64
+	MaxBytesPerSecond    int64
+
+	// MaxBucketRequestsPerSecond limits the write requests to each bucket
+	// independently of the other buckets, BucketRequestsPerSecond overrides
+	// the rate for specific buckets. Requests to throttled buckets are sent
+	// after the requests to other buckets of the same batch. Zero means
+	// unlimited.
+	MaxBucketRequestsPerSecond float64
+	BucketRequestsPerSecond    map[string]float64
+
+	// UDPFallbackURL is an address accepting line protocol over UDP, e.g.
+	// "udp://localhost:8089". After UDPFallbackAfter consecutive writes
+	// failed because the server is unreachable or unavailable, batches are
+	// sent there until writing over HTTP succeeds again. Datagrams can be
+	// lost without notice, are not authenticated and carry no bucket, so
+	// this trades delivery guarantees for keeping metrics flowing.
+	UDPFallbackURL   *url.URL
+	UDPFallbackAfter int
+
+	// CoalesceWindow collects batches smaller than CoalesceBytes per bucket
+	// for the given duration after the first one and writes them in a
+	// single request, e.g. for inputs flushing single metrics. Collected
+	// metrics are written once they reach CoalesceBytes, on Flush and on
+	// Close. As Write returns before they are written, failed writes of
+	// collected metrics are logged and the metrics dropped, Flush returns
+	// the error in addition. Zero disables coalescing.
+	CoalesceWindow time.Duration
+	CoalesceBytes  int64
+
+	// TokenFile is the path of a file to read the token from instead of
+	// passing it as Token, trailing whitespace is removed.
+	TokenFile string
+
+	// RetryableStatusCodes are response status codes to retry the write
+	// for in addition to 429, 502, 503 and 504, e.g. 408 returned by load
+	// balancers. They take precedence over the built-in handling of the
+	// codes.
+	RetryableStatusCodes []int
+
+	// DeleteBuckets, DeletePredicate, DeleteStart and DeleteStop delete the
+	// data matching the predicate between DeleteStart and DeleteStop ago
+	// from the listed buckets after every successful write request to them,
+	// e.g. to replace recomputed aggregates written by a backfill. Deletes are
+	// destructive, so the buckets, a predicate and a range ending in the past
+	// are required and the predicate must not match the data just written.
+	// Deletes are skipped if any metric just written is within the range.
+	// Failed deletes are logged and counted separately and do not fail the
+	// write.
+	DeleteBuckets   []string
+	DeletePredicate string
+	DeleteStart     time.Duration
+	DeleteStop      time.Duration
+
+	// HappyEyeballs connects over IPv4 and IPv6 in parallel after giving the
+	// preferred address family a head start of 50ms and uses the connection
+	// established first, instead of falling back after the default delay of
+	// 300ms. This reduces the connection latency on dual-stack hosts with
+	// broken IPv6 routing.
+	HappyEyeballs bool
+
+	// HTTP2 enables HTTP/2 for https URLs, multiplexing concurrent requests
+	// over a single connection. Plain http and unix socket URLs keep using
+	// HTTP/1.1.
+	HTTP2 bool
+
+	// MaxConcurrentBatches is the number of buckets written concurrently
+	// when the metrics are split into buckets, so a slow bucket does not
+	// block the others. Zero or one writes the buckets one after another.
+	// Concurrent writes cannot be combined with a tap or the UDP fallback,
+	// and a sink or the hooks must be safe for concurrent use.
+	MaxConcurrentBatches int
+
+	// AuthScheme selects how requests are authenticated, either "token"
+	// (default) sending the token in the Authorization header or "basic"
+	// using HTTP basic authentication with Username and Password, e.g. for
+	// API gateways in front of the server.
+	AuthScheme string
+	Username   string
+	Password   string
+
+	// WritePath, OrgIDPath and CreateOrgPath replace the API paths to write
+	// to, look up the organization ID at and create the organization at,
+	// e.g. for reverse proxies mounting the endpoints elsewhere. They are
+	// joined onto the path of the URL and default to the InfluxDB paths.
+	WritePath     string
+	OrgIDPath     string
+	CreateOrgPath string
+
+	// ComparisonSerializer and ComparisonBucket write every successfully
+	// written batch a second time to the comparison bucket, serialized with
+	// the comparison serializer, e.g. to validate serializer changes. This is
+	// best-effort and happens in the background, failures are logged only.
+	ComparisonSerializer serializers.Serializer
+	ComparisonBucket     string
+
+	// RetryProbeFraction lets a single write through as a probe once the
+	// given fraction of the wait requested by the server has passed. A
+	// successful probe ends the wait immediately, a failed one restarts it.
+	// Zero disables probing.
+	RetryProbeFraction float64
+
+	// BucketTokens maps buckets to the token used for writing to them, e.g.
+	// for buckets of different tenants. Other buckets use Token.
+	BucketTokens map[string]string
+
+	// MaxTags and MaxFields limit the number of tags and fields per metric,
+	// zero means unlimited. Metrics exceeding a limit are handled according
+	// to DimensionLimitPolicy, either "drop" (default) to drop the metric or
+	// "truncate" to keep the tags or fields with the lexically first keys.
+	MaxTags              int
+	MaxFields            int
+	DimensionLimitPolicy string
+
+	// MaintenanceHeader is the header by which the server marks a 503
+	// response as caused by maintenance. Writes are then held back for
+	// MaintenanceWait (default 5m) instead of the exponential backoff.
+	MaintenanceHeader string
+	MaintenanceWait   time.Duration
+
+	// BackfillAge routes metrics older than the given age to BackfillURL
+	// and BackfillBucket instead, e.g. to send backfilled data to a bulk
+	// endpoint. Either defaults to the primary setting if unset. Zero
+	// disables the routing.
+	BackfillAge    time.Duration
+	BackfillURL    *url.URL
+	BackfillBucket string
+
+	// DeduplicateBatches coalesces writes of a batch identical to one still
+	// being written or already written while retrying a failed write, so
+	// the batch is only sent once. Batches are identified by a hash of their
+	// content, at most MaxTrackedBatches (default 100) batches are tracked.
+	// Rewriting identical points is idempotent, so skipping them is safe.
+	DeduplicateBatches bool
+	MaxTrackedBatches  int
+
+	// OrderedWrites sorts the metrics of each bucket by timestamp before
+	// serialization and writes the chunks of a bucket strictly one after the
+	// other, trading throughput for monotonic ingestion.
+	OrderedWrites bool
+
+	// RetryAttemptTag, if set, adds the number of failed attempts as the
+	// given tag to the metrics of a batch resent unchanged after failing.
+	// Metrics written for the first time keep their tags.
+	RetryAttemptTag string
+
+	// BodySerializer, if set, serializes the metrics in place of line
+	// protocol, e.g. for compatible backends expecting other line formats.
+	// Metrics failing to serialize are skipped. BodyContentType is sent as
+	// the Content-Type of the requests and defaults to plain text.
+	BodySerializer  serializers.Serializer
+	BodyContentType string
 
 	Serializer *influx.Serializer
 	Log        telegraf.Logger
@@ -66,12 +601,131 @@ type httpClient struct {
 	BucketTag        string
 	ExcludeBucketTag bool
 
+	ClampFutureTimestamps    bool
+	FutureTimestampTolerance time.Duration
+	RoundTimestamps          time.Duration
+	NudgeDuplicateTimestamps bool
+	DuplicateTimestampOffset time.Duration
+	MaxBatchBytes            int64
+	MaxRetryWait             time.Duration
+	BrotliQuality            int
+	CompressionLevel         int
+	RetryAfterJitter         time.Duration
+	HostnameTag              string
+	ServerDryRun             bool
+	HeartbeatMeasurement     string
+	InvalidBucketPolicy      string
+	ReservedBucketPolicy     string
+	QuerySpaceEncoding       string
+	PriorityHeader           string
+	Priority                 string
+	BucketPriorities         map[string]string
+	Precision                string
+	DisableRetries           bool
+	DropUntagged             bool
+	FailFastOnAuthError      bool
+	MaxResponseBodySize      int64
+	MeasurementBuckets       map[string]string
+	AckTimeout               time.Duration
+	AckInterval              time.Duration
+	AdaptiveCompression      bool
+	CompressionLatencyLow    time.Duration
+	CompressionLatencyHigh   time.Duration
+	RetrySizeThreshold       int64
+	OnDelivery               func(Receipt)
+	OnWrite                  func(WriteStats)
+	RetryProbeFraction       float64
+	MaxTags                  int
+	MaxFields                int
+	DimensionLimitPolicy     string
+	MaintenanceHeader        string
+	MaintenanceWait          time.Duration
+	BackfillAge              time.Duration
+	OrderedWrites            bool
+	RetryAttemptTag          string
+	Tap                      io.Writer
+	OrganizationID           string
+	SoftErrorPolicy          string
+	FieldBuckets             map[string]string
+	SequenceHeader           string
+	BodyContentType          string
+	RetryStateFile           string
+	DropOutOfRetention       bool
+	InvalidUTF8Policy        string
+	CreateOrganization       bool
+	ComparisonSerializer     serializers.Serializer
+	ComparisonBucket         string
+	UDPFallbackAfter         int
+	DeletePredicate          string
+	DeleteStart              time.Duration
+	DeleteStop               time.Duration
+	MaxConcurrentBatches     int
+	AuthScheme               string
+	WritePath                string
+	OrgIDPath                string
+	CreateOrgPath            string
+
 	client     *http.Client
-	serializer *influx.Serializer
+	sink       LineProtocolSink
+	serializer serializers.Serializer
 	url        *url.URL
 	retryTime  time.Time
+	retryStart time.Time
 	retryCount int
+	hostname   string
 	log        telegraf.Logger
+
+	bucketAuth map[string]string
+	username   string
+	password   string
+	backfill   *httpClient
+	tlsConfig  *tls.Config
+	dedupe     *batchDeduplicator
+	sequence   *batchSequencer
+	attempts   *batchAttempts
+	latencies  *latencyRecorder
+
+	savedRetryState retryState
+	retentions      retentionCache
+	orgID           orgIDCache
+
+	mirrorClient  *http.Client
+	mirrorURL     *url.URL
+	mirrorHeaders map[string]string
+	mirrorWG      sync.WaitGroup
+
+	statsMu       sync.Mutex
+	statusCodes   map[int]int64
+	serverVersion ServerVersion
+
+	logFilter repeatFilter
+	pending   pendingQueue
+
+	metrics       *clientMetrics
+	compression   *compressionAdapter
+	excludeFields filter.Filter
+	inflight      *byteLimiter
+	requestRate   *rateLimiter
+	bucketRate    *bucketRateLimiter
+	udpFallback   *udpFallback
+	coalescer     *coalescer
+	coalesceMu    sync.Mutex
+	retryMu       sync.Mutex
+	httpFailures  int
+	byteRate      *rateLimiter
+	writeFormat   string
+	proxySet      bool
+	otlpConverter *influx2otel.LineProtocolToOtelMetrics
+
+	measurementRoutes []measurementRoute
+	routedFields      []string
+
+	retryableStatusCodes map[int]bool
+	deleteBuckets        map[string]bool
+
+	// gzipCompress compresses the request body with the given level,
+	// replaceable for testing
+	gzipCompress func(io.Reader, int) (io.ReadCloser, error)
 }
 
 func NewHTTPClient(config *HTTPConfig) (*httpClient, error) {
@@ -89,9 +743,37 @@ func NewHTTPClient(config *HTTPConfig) (*httpClient, error) {
 		userAgent = internal.ProductToken()
 	}
 
+	useOAuth2, err := checkOAuth2(config)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := readToken(config)
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.AuthScheme {
+	case "", "token":
+	case "basic":
+		if config.Username == "" || config.Password == "" {
+			return nil, errors.New("basic authentication requires a username and password")
+		}
+		if useOAuth2 || token != "" || len(config.BucketTokens) > 0 {
+			return nil, errors.New("basic authentication cannot be used together with a token")
+		}
+	default:
+		return nil, fmt.Errorf("invalid auth scheme %q", config.AuthScheme)
+	}
+
+	// Basic authentication is applied per request and OAuth2 by the client
+	useToken := !useOAuth2 && config.AuthScheme != "basic"
+
 	var headers = make(map[string]string, len(config.Headers)+2)
 	headers["User-Agent"] = userAgent
-	headers["Authorization"] = "Token " + config.Token
+	if useToken {
+		headers["Authorization"] = authorization(config, token)
+	}
 	for k, v := range config.Headers {
 		headers[k] = v
 	}
@@ -103,188 +785,1736 @@ func NewHTTPClient(config *HTTPConfig) (*httpClient, error) {
 		proxy = http.ProxyFromEnvironment
 	}
 
-	serializer := config.Serializer
-	if serializer == nil {
+	var serializer serializers.Serializer = config.Serializer
+	if config.BodySerializer != nil {
+		if config.WriteFormat == "otlp" {
+			return nil, errors.New("a body serializer cannot be used with the otlp write format")
+		}
+		serializer = config.BodySerializer
+	} else if config.Serializer == nil {
 		serializer = influx.NewSerializer()
 	}
+	if config.Sink != nil && config.WriteFormat == "otlp" {
+		return nil, errors.New("a line protocol sink cannot be used with the otlp write format")
+	}
 
-	var transport *http.Transport
-	switch config.URL.Scheme {
-	case "http", "https":
-		transport = &http.Transport{
-			Proxy:           proxy,
-			TLSClientConfig: config.TLSConfig,
+	organization, err := expandEnv(config.Organization)
+	if err != nil {
+		return nil, fmt.Errorf("organization: %w", err)
+	}
+	if err := checkOrganization(organization); err != nil {
+		return nil, fmt.Errorf("organization: %w", err)
+	}
+	if config.OrganizationID != "" {
+		if organization != "" {
+			return nil, errors.New("organization and organization ID cannot be combined")
 		}
-	case "unix":
-		transport = &http.Transport{
-			Dial: func(_, _ string) (net.Conn, error) {
-				return net.DialTimeout(
-					config.URL.Scheme,
-					config.URL.Path,
-					timeout,
-				)
-			},
+		if err := checkOrganization(config.OrganizationID); err != nil {
+			return nil, fmt.Errorf("organization ID: %w", err)
 		}
-	default:
-		return nil, fmt.Errorf("unsupported scheme %q", config.URL.Scheme)
 	}
-
-	client := &httpClient{
-		serializer: serializer,
-		client: &http.Client{
-			Timeout:   timeout,
-			Transport: transport,
-		},
-		url:              config.URL,
-		ContentEncoding:  config.ContentEncoding,
-		Timeout:          timeout,
-		Headers:          headers,
-		Organization:     config.Organization,
-		Bucket:           config.Bucket,
-		BucketTag:        config.BucketTag,
-		ExcludeBucketTag: config.ExcludeBucketTag,
-		log:              config.Log,
+	bucket, err := expandEnv(config.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("bucket: %w", err)
 	}
-	return client, nil
-}
-
-// URL returns the origin URL that this client connects too.
-func (c *httpClient) URL() string {
-	return c.url.String()
-}
-
-type genericRespError struct {
-	Code      string
-	Message   string
-	Line      *int32
-	MaxLength *int32
-}
-
-func (g genericRespError) Error() string {
-	errString := fmt.Sprintf("%s: %s", g.Code, g.Message)
-	if g.Line != nil {
-		return fmt.Sprintf("%s - line[%d]", errString, g.Line)
-	} else if g.MaxLength != nil {
-		return fmt.Sprintf("%s - maxlen[%d]", errString, g.MaxLength)
+	if config.BucketTag != "" && bucket == "" && !config.DropUntagged {
+		return nil, errors.New("a default bucket is required for metrics without the bucket tag")
 	}
-	return errString
-}
-
-func (c *httpClient) Write(ctx context.Context, metrics []telegraf.Metric) error {
-	if c.retryTime.After(time.Now()) {
-		return errors.New("retry time has not elapsed")
+	if config.HeartbeatMeasurement != "" && bucket == "" {
+		return nil, errors.New("a default bucket is required for heartbeats")
 	}
 
-	batches := make(map[string][]telegraf.Metric)
-	if c.BucketTag == "" {
-		err := c.writeBatch(ctx, c.Bucket, metrics)
-		if err != nil {
-			if err, ok := err.(*APIError); ok {
-				if err.StatusCode == http.StatusRequestEntityTooLarge {
-					return c.splitAndWriteBatch(ctx, c.Bucket, metrics)
-				}
-			}
+	switch config.InvalidBucketPolicy {
+	case "", "keep", "drop", "sanitize":
+	default:
+		return nil, fmt.Errorf("invalid bucket policy %q", config.InvalidBucketPolicy)
+	}
 
-			return err
-		}
-	} else {
-		for _, metric := range metrics {
-			bucket, ok := metric.GetTag(c.BucketTag)
-			if !ok {
-				bucket = c.Bucket
-			}
+	if err := checkDeleteConfig(config); err != nil {
+		return nil, err
+	}
 
-			if _, ok := batches[bucket]; !ok {
-				batches[bucket] = make([]telegraf.Metric, 0)
-			}
+	switch config.ReservedBucketPolicy {
+	case "", "keep", "default", "drop":
+	default:
+		return nil, fmt.Errorf("invalid reserved bucket policy %q", config.ReservedBucketPolicy)
+	}
 
-			if c.ExcludeBucketTag {
-				// Avoid modifying the metric in case we need to retry the request.
-				metric = metric.Copy()
-				metric.Accept()
-				metric.RemoveTag(c.BucketTag)
-			}
+	switch config.SoftErrorPolicy {
+	case "", "ignore", "warn":
+	default:
+		return nil, fmt.Errorf("invalid soft error policy %q", config.SoftErrorPolicy)
+	}
 
-			batches[bucket] = append(batches[bucket], metric)
-		}
+	switch config.DimensionLimitPolicy {
+	case "", "drop", "truncate":
+	default:
+		return nil, fmt.Errorf("invalid dimension limit policy %q", config.DimensionLimitPolicy)
+	}
 
-		for bucket, batch := range batches {
-			err := c.writeBatch(ctx, bucket, batch)
-			if err != nil {
-				if err, ok := err.(*APIError); ok {
-					if err.StatusCode == http.StatusRequestEntityTooLarge {
-						return c.splitAndWriteBatch(ctx, c.Bucket, metrics)
-					}
-				}
+	if (config.ComparisonSerializer == nil) != (config.ComparisonBucket == "") {
+		return nil, errors.New("comparison writes require both a serializer and a bucket")
+	}
 
-				return err
-			}
-		}
+	switch config.InvalidUTF8Policy {
+	case "", "keep", "scrub", "drop":
+	default:
+		return nil, fmt.Errorf("invalid UTF-8 policy %q", config.InvalidUTF8Policy)
 	}
-	return nil
-}
 
-func (c *httpClient) splitAndWriteBatch(ctx context.Context, bucket string, metrics []telegraf.Metric) error {
-	c.log.Warnf("Retrying write after splitting metric payload in half to reduce batch size")
-	midpoint := len(metrics) / 2
+	switch config.ContentEncoding {
+	case "", "identity", "gzip", "br":
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", config.ContentEncoding)
+	}
 
-	if err := c.writeBatch(ctx, bucket, metrics[:midpoint]); err != nil {
-		return err
+	switch config.QuerySpaceEncoding {
+	case "", "plus", "percent":
+	default:
+		return nil, fmt.Errorf("invalid query space encoding %q", config.QuerySpaceEncoding)
 	}
 
-	return c.writeBatch(ctx, bucket, metrics[midpoint:])
-}
+	// The serializer has no notion of precision and always writes timestamps
+	// in nanoseconds, announcing anything else would silently corrupt them.
+	switch config.Precision {
+	case "", "ns":
+	default:
+		return nil, fmt.Errorf("precision %q does not match the nanosecond precision of the serializer", config.Precision)
+	}
 
-func (c *httpClient) writeBatch(ctx context.Context, bucket string, metrics []telegraf.Metric) error {
-	loc, err := makeWriteURL(*c.url, c.Organization, bucket)
+	measurementRoutes, err := compileMeasurementRoutes(config.MeasurementBuckets)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	reader, err := c.requestBodyReader(metrics)
-	if err != nil {
-		return err
+	routedFields := make([]string, 0, len(config.FieldBuckets))
+	for field := range config.FieldBuckets {
+		routedFields = append(routedFields, field)
 	}
-	defer reader.Close()
+	sort.Strings(routedFields)
 
-	req, err := c.makeWriteRequest(loc, reader)
+	excludeFields, err := filter.Compile(config.ExcludeFields)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("compiling field exclusion filter failed: %w", err)
 	}
 
-	resp, err := c.client.Do(req.WithContext(ctx))
-	if err != nil {
-		internal.OnClientError(c.client, err)
-		return err
+	brotliQuality := config.BrotliQuality
+	if brotliQuality == 0 {
+		brotliQuality = brotli.DefaultCompression
+	}
+	if brotliQuality < brotli.BestSpeed || brotliQuality > brotli.BestCompression {
+		return nil, fmt.Errorf("invalid brotli quality %d", config.BrotliQuality)
 	}
-	defer resp.Body.Close()
 
-	switch resp.StatusCode {
-	case
-		// this is the expected response:
-		http.StatusNoContent,
-		// but if we get these we should still accept it as delivered:
-		http.StatusOK,
-		http.StatusCreated,
-		http.StatusAccepted,
-		http.StatusPartialContent,
-		http.StatusMultiStatus,
-		http.StatusAlreadyReported:
-		c.retryCount = 0
-		return nil
+	compressionLevel := config.CompressionLevel
+	if compressionLevel == 0 {
+		compressionLevel = gzip.DefaultCompression
+	}
+	if compressionLevel < gzip.HuffmanOnly || compressionLevel > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid compression level %d", config.CompressionLevel)
 	}
 
-	writeResp := &genericRespError{}
-	err = json.NewDecoder(resp.Body).Decode(writeResp)
-	desc := writeResp.Error()
-	if err != nil {
-		desc = resp.Status
+	maxResponseBodySize := config.MaxResponseBodySize
+	if maxResponseBodySize <= 0 {
+		maxResponseBodySize = defaultMaxResponseBodySize
 	}
 
-	switch resp.StatusCode {
-	// request was too large, send back to try again
+	if config.RetryProbeFraction < 0 || config.RetryProbeFraction >= 1 {
+		return nil, fmt.Errorf("invalid retry probe fraction %v", config.RetryProbeFraction)
+	}
+
+	if config.AckTimeout < 0 {
+		return nil, fmt.Errorf("invalid acknowledgment timeout %s", config.AckTimeout)
+	}
+	ackInterval := config.AckInterval
+	if ackInterval == 0 {
+		ackInterval = defaultAckInterval
+	}
+	if ackInterval < 0 {
+		return nil, fmt.Errorf("invalid acknowledgment interval %s", config.AckInterval)
+	}
+
+	if config.AdaptiveCompression {
+		switch config.ContentEncoding {
+		case "gzip", "br":
+		default:
+			return nil, errors.New("adaptive compression requires a compressing content encoding")
+		}
+		if config.CompressionLatencyLow <= 0 || config.CompressionLatencyHigh <= config.CompressionLatencyLow {
+			return nil, fmt.Errorf("invalid compression latency thresholds %s and %s",
+				config.CompressionLatencyLow, config.CompressionLatencyHigh)
+		}
+	}
+
+	maintenanceWait := config.MaintenanceWait
+	if maintenanceWait <= 0 {
+		maintenanceWait = defaultMaintenanceWait
+	}
+
+	duplicateOffset := config.DuplicateTimestampOffset
+	if duplicateOffset == 0 {
+		duplicateOffset = time.Nanosecond
+	}
+	if duplicateOffset < 0 {
+		return nil, fmt.Errorf("invalid duplicate timestamp offset %s", config.DuplicateTimestampOffset)
+	}
+
+	if config.MaxIdleConnAge < 0 {
+		return nil, fmt.Errorf("invalid maximum idle connection age %s", config.MaxIdleConnAge)
+	}
+
+	comparisonSerializer := config.ComparisonSerializer
+	switch {
+	case config.MaxConcurrentBatches < 0:
+		return nil, fmt.Errorf("invalid maximum concurrent batches %d", config.MaxConcurrentBatches)
+	case config.MaxConcurrentBatches > 1:
+		if config.Tap != nil {
+			return nil, errors.New("concurrent batches cannot be used with a tap")
+		}
+		if config.UDPFallbackURL != nil {
+			return nil, errors.New("concurrent batches cannot be used with the UDP fallback")
+		}
+		serializer = &lockedSerializer{serializer: serializer}
+		if comparisonSerializer != nil {
+			comparisonSerializer = &lockedSerializer{serializer: comparisonSerializer}
+		}
+	}
+
+	transport, err := newTransport(config.URL, proxy, config.TLSConfig, timeout, config.HappyEyeballs, config.HTTP2)
+	if err != nil {
+		return nil, err
+	}
+	transport.IdleConnTimeout = config.MaxIdleConnAge
+
+	client := &httpClient{
+		sink:       config.Sink,
+		serializer: serializer,
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: wrapTransport(config, transport),
+		},
+		url:              config.URL,
+		ContentEncoding:  config.ContentEncoding,
+		Timeout:          timeout,
+		Headers:          headers,
+		Organization:     organization,
+		Bucket:           bucket,
+		BucketTag:        config.BucketTag,
+		ExcludeBucketTag: config.ExcludeBucketTag,
+		log:              config.Log,
+
+		ClampFutureTimestamps:    config.ClampFutureTimestamps,
+		FutureTimestampTolerance: config.FutureTimestampTolerance,
+		RoundTimestamps:          config.RoundTimestamps,
+		NudgeDuplicateTimestamps: config.NudgeDuplicateTimestamps,
+		DuplicateTimestampOffset: duplicateOffset,
+		MaxBatchBytes:            config.MaxBatchBytes,
+		MaxRetryWait:             config.MaxRetryWait,
+		BrotliQuality:            brotliQuality,
+		CompressionLevel:         compressionLevel,
+		RetryAfterJitter:         config.RetryAfterJitter,
+		HostnameTag:              config.HostnameTag,
+		ServerDryRun:             config.ServerDryRun,
+		HeartbeatMeasurement:     config.HeartbeatMeasurement,
+		InvalidBucketPolicy:      config.InvalidBucketPolicy,
+		ReservedBucketPolicy:     config.ReservedBucketPolicy,
+		QuerySpaceEncoding:       config.QuerySpaceEncoding,
+		PriorityHeader:           config.PriorityHeader,
+		Priority:                 config.Priority,
+		BucketPriorities:         config.BucketPriorities,
+		Precision:                config.Precision,
+		DisableRetries:           config.DisableRetries,
+		DropUntagged:             config.DropUntagged,
+		FailFastOnAuthError:      config.FailFastOnAuthError,
+		MaxResponseBodySize:      maxResponseBodySize,
+		MeasurementBuckets:       config.MeasurementBuckets,
+		AckTimeout:               config.AckTimeout,
+		AckInterval:              ackInterval,
+		AdaptiveCompression:      config.AdaptiveCompression,
+		CompressionLatencyLow:    config.CompressionLatencyLow,
+		CompressionLatencyHigh:   config.CompressionLatencyHigh,
+		RetrySizeThreshold:       config.RetrySizeThreshold,
+		OnDelivery:               config.OnDelivery,
+		OnWrite:                  config.OnWrite,
+		RetryProbeFraction:       config.RetryProbeFraction,
+		MaxTags:                  config.MaxTags,
+		MaxFields:                config.MaxFields,
+		DimensionLimitPolicy:     config.DimensionLimitPolicy,
+		MaintenanceHeader:        config.MaintenanceHeader,
+		MaintenanceWait:          maintenanceWait,
+		BackfillAge:              config.BackfillAge,
+		OrderedWrites:            config.OrderedWrites,
+		RetryAttemptTag:          config.RetryAttemptTag,
+		Tap:                      config.Tap,
+		OrganizationID:           config.OrganizationID,
+		SoftErrorPolicy:          config.SoftErrorPolicy,
+		FieldBuckets:             config.FieldBuckets,
+		SequenceHeader:           config.SequenceHeader,
+		BodyContentType:          config.BodyContentType,
+		RetryStateFile:           config.RetryStateFile,
+		DropOutOfRetention:       config.DropOutOfRetention,
+		InvalidUTF8Policy:        config.InvalidUTF8Policy,
+		CreateOrganization:       config.CreateOrganization,
+		ComparisonSerializer:     comparisonSerializer,
+		ComparisonBucket:         config.ComparisonBucket,
+		UDPFallbackAfter:         config.UDPFallbackAfter,
+		DeletePredicate:          config.DeletePredicate,
+		DeleteStart:              config.DeleteStart,
+		DeleteStop:               config.DeleteStop,
+		MaxConcurrentBatches:     config.MaxConcurrentBatches,
+		AuthScheme:               config.AuthScheme,
+		WritePath:                config.WritePath,
+		OrgIDPath:                config.OrgIDPath,
+		CreateOrgPath:            config.CreateOrgPath,
+		username:                 config.Username,
+		password:                 config.Password,
+		measurementRoutes:        measurementRoutes,
+		routedFields:             routedFields,
+		statusCodes:              make(map[int]int64),
+		logFilter:                repeatFilter{window: config.LogSuppressionWindow},
+		metrics:                  newClientMetrics(),
+		proxySet:                 config.Proxy != nil,
+		excludeFields:            excludeFields,
+	}
+
+	if config.MaxInFlightBytes > 0 {
+		client.inflight = &byteLimiter{limit: config.MaxInFlightBytes}
+	}
+
+	if config.AdaptiveCompression {
+		client.compression = &compressionAdapter{
+			low:  config.CompressionLatencyLow,
+			high: config.CompressionLatencyHigh,
+		}
+	}
+
+	if config.MaxRequestsPerSecond > 0 {
+		client.requestRate = newRateLimiter(config.MaxRequestsPerSecond)
+	}
+	if config.MaxBytesPerSecond > 0 {
+		client.byteRate = newRateLimiter(float64(config.MaxBytesPerSecond))
+	}
+	if config.MaxBucketRequestsPerSecond > 0 || len(config.BucketRequestsPerSecond) > 0 {
+		client.bucketRate = newBucketRateLimiter(config.MaxBucketRequestsPerSecond, config.BucketRequestsPerSecond)
+	}
+
+	if len(config.DeleteBuckets) > 0 {
+		client.deleteBuckets = make(map[string]bool, len(config.DeleteBuckets))
+		for _, bucket := range config.DeleteBuckets {
+			client.deleteBuckets[bucket] = true
+		}
+	}
+
+	if len(config.RetryableStatusCodes) > 0 {
+		client.retryableStatusCodes = make(map[int]bool, len(config.RetryableStatusCodes))
+		for _, code := range config.RetryableStatusCodes {
+			if code < 300 || code > 599 {
+				return nil, fmt.Errorf("invalid retryable status code %d", code)
+			}
+			client.retryableStatusCodes[code] = true
+		}
+	}
+
+	if config.CoalesceWindow > 0 {
+		limit := config.CoalesceBytes
+		if limit <= 0 {
+			limit = defaultCoalesceBytes
+		}
+		client.coalescer = newCoalescer(config.CoalesceWindow, limit, &client.pending, client.writeCoalesced)
+	}
+
+	if client.WritePath == "" {
+		client.WritePath = defaultWritePath
+	}
+	if client.OrgIDPath == "" {
+		client.OrgIDPath = defaultOrgsPath
+	}
+	if client.CreateOrgPath == "" {
+		client.CreateOrgPath = defaultOrgsPath
+	}
+
+	if config.UDPFallbackURL != nil {
+		client.udpFallback, err = newUDPFallback(config.UDPFallbackURL)
+		if err != nil {
+			return nil, fmt.Errorf("UDP fallback: %w", err)
+		}
+		if client.UDPFallbackAfter <= 0 {
+			client.UDPFallbackAfter = defaultUDPFallbackAfter
+		}
+	}
+
+	if len(config.BucketTokens) > 0 {
+		client.bucketAuth = make(map[string]string, len(config.BucketTokens))
+		for bucket, token := range config.BucketTokens {
+			client.bucketAuth[bucket] = authorization(config, token)
+		}
+	}
+
+	if useOAuth2 {
+		client.client = config.OAuth2.CreateOauth2Client(context.Background(), client.client)
+		client.client.Timeout = timeout
+	}
+
+	switch config.WriteFormat {
+	case "", "influx":
+		client.writeFormat = "influx"
+	case "otlp":
+		client.writeFormat = config.WriteFormat
+		client.otlpConverter, err = influx2otel.NewLineProtocolToOtelMetrics(otlpLogger{config.Log})
+		if err != nil {
+			return nil, fmt.Errorf("creating OTLP converter failed: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported write format %q", config.WriteFormat)
+	}
+
+	if config.HostnameTag != "" {
+		client.hostname, err = os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("getting hostname failed: %w", err)
+		}
+	}
+
+	client.tlsConfig = config.TLSConfig
+
+	if config.RetryStateFile != "" {
+		if err := client.loadRetryState(time.Now()); err != nil {
+			client.log.Warnf("Loading retry state from %q failed, starting without backoff: %v", config.RetryStateFile, err)
+		}
+	}
+
+	if config.DeduplicateBatches {
+		limit := config.MaxTrackedBatches
+		if limit <= 0 {
+			limit = defaultMaxTrackedBatches
+		}
+		client.dedupe = &batchDeduplicator{limit: limit}
+	}
+
+	if config.SequenceHeader != "" {
+		client.sequence = &batchSequencer{limit: defaultMaxTrackedBatches}
+	}
+
+	if config.RetryAttemptTag != "" {
+		client.attempts = &batchAttempts{limit: defaultMaxTrackedBatches}
+	}
+
+	if len(config.LatencyBuckets) > 0 {
+		client.latencies = newLatencyRecorder(config.LatencyBuckets)
+	}
+
+	if config.BackfillAge > 0 {
+		backfillConfig := *config
+		backfillConfig.BackfillAge = 0
+		backfillConfig.BackfillURL = nil
+		backfillConfig.BackfillBucket = ""
+		// The backfill client might share the URL and with it the state
+		backfillConfig.RetryStateFile = ""
+		// Datagrams carry no bucket, so backfilled metrics would end up in
+		// the wrong bucket
+		backfillConfig.UDPFallbackURL = nil
+		if config.BackfillURL != nil {
+			backfillConfig.URL = config.BackfillURL
+		}
+		if config.BackfillBucket != "" {
+			backfillConfig.Bucket = config.BackfillBucket
+		}
+		client.backfill, err = NewHTTPClient(&backfillConfig)
+		if err != nil {
+			return nil, fmt.Errorf("backfill: %w", err)
+		}
+	} else if config.BackfillURL != nil || config.BackfillBucket != "" {
+		return nil, errors.New("backfill requires a backfill age")
+	}
+
+	if config.MirrorURL != nil {
+		mirrorTransport, err := newTransport(config.MirrorURL, proxy, config.TLSConfig, timeout, config.HappyEyeballs, config.HTTP2)
+		if err != nil {
+			return nil, fmt.Errorf("mirror: %w", err)
+		}
+		mirrorTransport.IdleConnTimeout = config.MaxIdleConnAge
+
+		client.mirrorClient = &http.Client{
+			Timeout:   timeout,
+			Transport: wrapTransport(config, mirrorTransport),
+		}
+		client.mirrorURL = config.MirrorURL
+		client.mirrorHeaders = make(map[string]string, len(headers))
+		for k, v := range headers {
+			client.mirrorHeaders[k] = v
+		}
+		if useToken {
+			mirrorToken := config.MirrorToken
+			if mirrorToken == "" {
+				mirrorToken = token
+			}
+			client.mirrorHeaders["Authorization"] = authorization(config, mirrorToken)
+		}
+	}
+
+	return client, nil
+}
+
+func wrapTransport(config *HTTPConfig, transport *http.Transport) http.RoundTripper {
+	if config.WrapTransport == nil {
+		return transport
+	}
+	return config.WrapTransport(transport)
+}
+
+// checkOrganization rejects organization names containing characters likely
+// to break the routing of requests by servers or gateways in between.
+func checkOrganization(name string) error {
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("%q is not valid UTF-8", name)
+	}
+	if strings.TrimSpace(name) != name {
+		return fmt.Errorf("%q has leading or trailing whitespace", name)
+	}
+	for _, r := range name {
+		switch {
+		case unicode.IsControl(r):
+			return fmt.Errorf("%q contains control characters", name)
+		case r == '/' || r == '\\':
+			return fmt.Errorf("%q contains slashes, which break the routing of some servers; "+
+				"reference the organization by ID instead", name)
+		}
+	}
+	return nil
+}
+
+// envReference matches a ${VAR} reference to an environment variable.
+var envReference = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// expandEnv replaces ${VAR} references in the string by the value of the
+// corresponding environment variable. Any other "$" is kept as is, as it
+// might be part of the name. Referencing an unset variable is an error.
+func expandEnv(s string) (string, error) {
+	var missing []string
+	expanded := envReference.ReplaceAllStringFunc(s, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable(s) %s not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// authorization returns the value of the Authorization header for the given
+// token according to the configured prefix settings.
+func authorization(config *HTTPConfig, token string) string {
+	if config.OmitTokenPrefix {
+		return token
+	}
+
+	prefix := config.TokenPrefix
+	if prefix == "" {
+		prefix = defaultTokenPrefix
+	}
+	return prefix + " " + token
+}
+
+// checkOAuth2 returns true if OAuth2 is configured completely and not mixed
+// with a static token.
+func checkOAuth2(config *HTTPConfig) (bool, error) {
+	o := config.OAuth2
+	if o.ClientID == "" && o.ClientSecret == "" && o.TokenURL == "" {
+		return false, nil
+	}
+	if o.ClientID == "" || o.ClientSecret == "" || o.TokenURL == "" {
+		return false, errors.New("OAuth2 requires client_id, client_secret and token_url")
+	}
+	if config.Token != "" || config.TokenFile != "" || len(config.BucketTokens) > 0 {
+		return false, errors.New("OAuth2 cannot be used together with a token")
+	}
+	return true, nil
+}
+
+// readToken returns the configured token, reading it from the token file if
+// given.
+func readToken(config *HTTPConfig) (string, error) {
+	if config.TokenFile == "" {
+		return config.Token, nil
+	}
+	if config.Token != "" {
+		return "", errors.New("token and token file cannot be combined")
+	}
+
+	content, err := os.ReadFile(config.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("reading token file failed: %w", err)
+	}
+	token := strings.TrimRightFunc(string(content), unicode.IsSpace)
+	if token == "" {
+		return "", fmt.Errorf("token file %q is empty", config.TokenFile)
+	}
+	return token, nil
+}
+
+func newTransport(u *url.URL, proxy func(*http.Request) (*url.URL, error), tlsConfig *tls.Config, timeout time.Duration, happyEyeballs, enableHTTP2 bool) (*http.Transport, error) {
+	switch u.Scheme {
+	case "http", "https":
+		transport := &http.Transport{
+			Proxy:           proxy,
+			TLSClientConfig: tlsConfig,
+		}
+		if happyEyeballs {
+			transport.DialContext = happyEyeballsDialer(timeout).DialContext
+		}
+		if enableHTTP2 {
+			// Configuring HTTP/2 modifies the TLS config to negotiate "h2"
+			transport.TLSClientConfig = tlsConfig.Clone()
+			if err := http2.ConfigureTransport(transport); err != nil {
+				return nil, fmt.Errorf("configuring HTTP/2 failed: %w", err)
+			}
+		}
+		return transport, nil
+	case "unix":
+		return &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.DialTimeout(
+					u.Scheme,
+					u.Path,
+					timeout,
+				)
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+}
+
+// URL returns the origin URL that this client connects too.
+func (c *httpClient) URL() string {
+	return c.url.String()
+}
+
+// EffectiveConfig holds the non-secret configuration of a client, e.g. for
+// debugging endpoints. It never contains the token or other credentials.
+type EffectiveConfig struct {
+	URL             string
+	Organization    string
+	Bucket          string
+	BucketTag       string
+	ContentEncoding string
+	Timeout         time.Duration
+	TLSEnabled      bool
+	ProxySet        bool
+}
+
+// EffectiveConfig returns the configuration the client is running with.
+// Credentials in the URL are redacted and the token is left out.
+func (c *httpClient) EffectiveConfig() EffectiveConfig {
+	return EffectiveConfig{
+		URL:             c.url.Redacted(),
+		Organization:    c.Organization,
+		Bucket:          c.Bucket,
+		BucketTag:       c.BucketTag,
+		ContentEncoding: c.ContentEncoding,
+		Timeout:         c.Timeout,
+		TLSEnabled:      c.url.Scheme == "https",
+		ProxySet:        c.proxySet,
+	}
+}
+
+// Transport returns the RoundTripper used for requests to the server.
+func (c *httpClient) Transport() http.RoundTripper {
+	return c.client.Transport
+}
+
+type genericRespError struct {
+	Code      string
+	Message   string
+	Line      *int32
+	MaxLength *int32
+}
+
+func (g genericRespError) Error() string {
+	errString := fmt.Sprintf("%s: %s", g.Code, g.Message)
+	if g.Line != nil {
+		return fmt.Sprintf("%s - line[%d]", errString, g.Line)
+	} else if g.MaxLength != nil {
+		return fmt.Sprintf("%s - maxlen[%d]", errString, g.MaxLength)
+	}
+	return errString
+}
+
+// limitedBody is a response body truncated to a maximum size.
+type limitedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// limitBody restricts reading the body of the response to the configured
+// maximum size, protecting against huge bodies sent by broken servers.
+func (c *httpClient) limitBody(resp *http.Response) {
+	resp.Body = limitedBody{
+		Reader: io.LimitReader(resp.Body, c.MaxResponseBodySize),
+		Closer: resp.Body,
+	}
+}
+
+// errorDescription extracts a description of the error from the response
+// body. JSON bodies are decoded as error object, plain text bodies are used
+// verbatim. In all other cases, including an empty body, the response status
+// is used. Bodies without a Content-Type are tried as JSON.
+func errorDescription(resp *http.Response) string {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = ""
+	}
+
+	switch {
+	case mediaType == "", mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+		// Only the first JSON object is decoded, any trailing data sent by
+		// misbehaving servers or proxies is ignored.
+		writeResp := &genericRespError{}
+		if err := json.NewDecoder(resp.Body).Decode(writeResp); err != nil {
+			return resp.Status
+		}
+		return writeResp.Error()
+	case strings.HasPrefix(mediaType, "text/"):
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return resp.Status
+		}
+		if desc := strings.TrimSpace(string(body)); desc != "" {
+			return desc
+		}
+	}
+	return resp.Status
+}
+
+func (c *httpClient) Write(ctx context.Context, metrics []telegraf.Metric) (err error) {
+	if c.coalescer != nil {
+		// Coalesced metrics are written in the background
+		c.coalesceMu.Lock()
+		defer c.coalesceMu.Unlock()
+	}
+
+	now := wallNow()
+	if c.backfill != nil && len(metrics) > 0 {
+		var old []telegraf.Metric
+		metrics, old = c.splitByAge(metrics, now)
+		if len(metrics) == 0 {
+			if err := c.backfill.Write(ctx, old); err != nil {
+				return fmt.Errorf("backfill: %w", err)
+			}
+			return nil
+		}
+		if len(old) > 0 {
+			// Backfill only after the recent metrics were written, as the
+			// whole batch is sent again if holding back or failing below.
+			defer func() {
+				if err != nil {
+					return
+				}
+				if backfillErr := c.backfill.Write(ctx, old); backfillErr != nil {
+					err = fmt.Errorf("backfill: %w", backfillErr)
+				}
+			}()
+		}
+	}
+
+	if c.RetryStateFile != "" {
+		defer c.saveRetryState()
+	}
+
+	if c.dedupe != nil {
+		defer func() {
+			if err == nil {
+				c.dedupe.reset()
+			}
+		}()
+	}
+
+	c.retryMu.Lock()
+	if c.MaxRetryWait > 0 && c.retryTime.After(now.Add(c.MaxRetryWait)) {
+		// The wall clock jumped backwards, don't hold back writes longer
+		// than configured.
+		c.retryTime = now.Add(c.MaxRetryWait)
+	}
+	retryTime, probe := c.retryTime, c.probeDue(now)
+	c.retryMu.Unlock()
+	if retryTime.After(now) {
+		if probe {
+			defer func() { c.endProbe(now, err) }()
+		} else if !c.udpFallbackActive() {
+			return &RetryError{retryTime: retryTime}
+		}
+	}
+
+	if c.compression != nil && c.compression.update() {
+		c.log.Debugf("Switched to content encoding %q based on the write latency", c.contentEncoding())
+	}
+
+	if c.excludeFields != nil {
+		metrics = c.removeExcludedFields(metrics)
+	}
+
+	switch c.InvalidUTF8Policy {
+	case "scrub", "drop":
+		metrics = c.handleInvalidUTF8(metrics)
+	}
+
+	metrics = c.dropFieldless(metrics)
+	if len(metrics) == 0 {
+		if c.HeartbeatMeasurement == "" {
+			return nil
+		}
+		// The heartbeat always goes to the default bucket, so it is not
+		// subject to routing or dropping untagged metrics.
+		return c.sendBatches(ctx, c.Bucket, []telegraf.Metric{c.heartbeat()})
+	}
+
+	id := c.pending.add(len(metrics), time.Now())
+	defer c.pending.done(id)
+
+	if c.ClampFutureTimestamps {
+		metrics = c.clampFutureTimestamps(metrics)
+	}
+
+	if c.RoundTimestamps > 0 {
+		metrics = c.roundTimestamps(metrics)
+	}
+
+	if c.NudgeDuplicateTimestamps {
+		metrics = c.nudgeDuplicateTimestamps(metrics)
+	}
+
+	if c.HostnameTag != "" {
+		metrics = c.addHostnameTag(metrics)
+	}
+
+	if c.MaxTags > 0 || c.MaxFields > 0 {
+		metrics = c.limitDimensions(metrics)
+	}
+
+	batches := make(map[string][]telegraf.Metric)
+	if c.BucketTag == "" && len(c.MeasurementBuckets) == 0 && len(c.FieldBuckets) == 0 {
+		err := c.writeBatches(ctx, c.Bucket, metrics)
+		if err != nil {
+			return err
+		}
+	} else {
+		var invalid, untagged, reserved int
+		for _, metric := range metrics {
+			var bucket string
+			var ok bool
+			if c.BucketTag != "" {
+				bucket, ok = metric.GetTag(c.BucketTag)
+			}
+			if !ok {
+				if bucket, ok = c.fieldBucket(metric); !ok {
+					bucket, ok = c.measurementBucket(metric.Name())
+				}
+				if !ok && c.DropUntagged {
+					untagged++
+					continue
+				} else if !ok {
+					bucket = c.Bucket
+				}
+			} else if bucket, ok = c.checkBucketName(bucket); !ok {
+				invalid++
+				continue
+			} else if strings.HasPrefix(bucket, "_") {
+				switch c.ReservedBucketPolicy {
+				case "default":
+					reserved++
+					bucket = c.Bucket
+				case "drop":
+					reserved++
+					continue
+				}
+			}
+
+			if _, ok := batches[bucket]; !ok {
+				batches[bucket] = make([]telegraf.Metric, 0)
+			}
+
+			if c.ExcludeBucketTag {
+				// Avoid modifying the metric in case we need to retry the request.
+				metric = metric.Copy()
+				metric.Accept()
+				metric.RemoveTag(c.BucketTag)
+			}
+
+			batches[bucket] = append(batches[bucket], metric)
+		}
+
+		if invalid > 0 {
+			c.logErrorf("Dropped %d metric(s) with invalid bucket name", invalid)
+			c.metrics.drop(dropInvalidBucket, invalid)
+		}
+		if reserved > 0 && c.ReservedBucketPolicy == "drop" {
+			c.logWarnf("Dropped %d metric(s) with reserved bucket name", reserved)
+			c.metrics.drop(dropReservedBucket, reserved)
+		} else if reserved > 0 {
+			c.logWarnf("Wrote %d metric(s) with reserved bucket name to bucket %s", reserved, c.Bucket)
+		}
+		if untagged > 0 {
+			c.log.Debugf("Dropped %d metric(s) without bucket tag", untagged)
+			c.metrics.drop(dropUntagged, untagged)
+		}
+
+		// Keep writing the remaining buckets if one fails, so a single bad
+		// bucket does not block the healthy ones.
+		buckets := make([]string, 0, len(batches))
+		for bucket := range batches {
+			buckets = append(buckets, bucket)
+		}
+		if c.bucketRate != nil {
+			c.bucketRate.order(buckets)
+		}
+
+		return c.writeBuckets(ctx, buckets, batches)
+	}
+	return nil
+}
+
+// isAuthError returns true if the server rejected the credentials.
+func isAuthError(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden
+}
+
+func isTooLargeError(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.StatusCode == http.StatusRequestEntityTooLarge
+}
+
+// joinErrors combines the errors of writes to multiple buckets into one.
+func joinErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return multiError(errs)
+}
+
+// multiError holds the errors of several writes. Checking it with errors.Is
+// or errors.As matches any of the errors, so e.g. an authentication failure
+// is still detected if several buckets failed.
+type multiError []error
+
+func (m multiError) Error() string {
+	msgs := make([]string, 0, len(m))
+	for _, err := range m {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("writing to %d bucket(s) failed: %s", len(m), strings.Join(msgs, "; "))
+}
+
+func (m multiError) Is(target error) bool {
+	for _, err := range m {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiError) As(target interface{}) bool {
+	for _, err := range m {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// measurementRoute sends measurements matching the filter to the bucket.
+type measurementRoute struct {
+	filter filter.Filter
+	bucket string
+}
+
+// compileMeasurementRoutes compiles the glob patterns of the measurement to
+// bucket mapping in lexical order.
+func compileMeasurementRoutes(buckets map[string]string) ([]measurementRoute, error) {
+	patterns := make([]string, 0, len(buckets))
+	for pattern := range buckets {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	routes := make([]measurementRoute, 0, len(patterns))
+	for _, pattern := range patterns {
+		f, err := filter.Compile([]string{pattern})
+		if err != nil {
+			return nil, fmt.Errorf("compiling measurement bucket pattern %q failed: %w", pattern, err)
+		}
+		routes = append(routes, measurementRoute{filter: f, bucket: buckets[pattern]})
+	}
+	return routes, nil
+}
+
+// measurementBucket returns the bucket the measurement is mapped to.
+func (c *httpClient) measurementBucket(name string) (string, bool) {
+	if bucket, ok := c.MeasurementBuckets[name]; ok {
+		return bucket, true
+	}
+	for _, route := range c.measurementRoutes {
+		if route.filter.Match(name) {
+			return route.bucket, true
+		}
+	}
+	return "", false
+}
+
+// fieldBucket returns the bucket of the first routed field the metric has.
+func (c *httpClient) fieldBucket(metric telegraf.Metric) (string, bool) {
+	for _, field := range c.routedFields {
+		if metric.HasField(field) {
+			return c.FieldBuckets[field], true
+		}
+	}
+	return "", false
+}
+
+// splitByAge separates the metrics older than the backfill age from the
+// recent ones.
+func (c *httpClient) splitByAge(metrics []telegraf.Metric, now time.Time) (recent, old []telegraf.Metric) {
+	limit := now.Add(-c.BackfillAge)
+	for _, metric := range metrics {
+		if metric.Time().Before(limit) {
+			old = append(old, metric)
+		} else {
+			recent = append(recent, metric)
+		}
+	}
+	return recent, old
+}
+
+// heartbeat creates the metric sent in place of an empty write to signal
+// that the agent is alive.
+func (c *httpClient) heartbeat() telegraf.Metric {
+	return metric.New(
+		c.HeartbeatMeasurement,
+		map[string]string{},
+		map[string]interface{}{"alive": true},
+		time.Now(),
+	)
+}
+
+// removeExcludedFields removes the fields matching the exclusion filter.
+func (c *httpClient) removeExcludedFields(metrics []telegraf.Metric) []telegraf.Metric {
+	var removed int
+	metrics, _ = copyOnWrite(metrics,
+		func(m telegraf.Metric) bool {
+			for _, field := range m.FieldList() {
+				if c.excludeFields.Match(field.Key) {
+					return true
+				}
+			}
+			return false
+		},
+		func(m telegraf.Metric) {
+			var keys []string
+			for _, field := range m.FieldList() {
+				if c.excludeFields.Match(field.Key) {
+					keys = append(keys, field.Key)
+				}
+			}
+			for _, key := range keys {
+				m.RemoveField(key)
+			}
+			removed += len(keys)
+		},
+	)
+	if removed > 0 {
+		c.log.Debugf("Removed %d excluded field(s)", removed)
+	}
+	return metrics
+}
+
+// limitDimensions drops or truncates metrics with more tags or fields than
+// allowed according to the dimension limit policy.
+func (c *httpClient) limitDimensions(metrics []telegraf.Metric) []telegraf.Metric {
+	exceeds := func(m telegraf.Metric) bool {
+		return (c.MaxTags > 0 && len(m.TagList()) > c.MaxTags) ||
+			(c.MaxFields > 0 && len(m.FieldList()) > c.MaxFields)
+	}
+
+	if c.DimensionLimitPolicy == "truncate" {
+		metrics, truncated := copyOnWrite(metrics, exceeds, func(m telegraf.Metric) {
+			if c.MaxTags > 0 {
+				keys := make([]string, 0, len(m.TagList()))
+				for _, tag := range m.TagList() {
+					keys = append(keys, tag.Key)
+				}
+				for _, key := range excessKeys(keys, c.MaxTags) {
+					m.RemoveTag(key)
+				}
+			}
+			if c.MaxFields > 0 {
+				keys := make([]string, 0, len(m.FieldList()))
+				for _, field := range m.FieldList() {
+					keys = append(keys, field.Key)
+				}
+				for _, key := range excessKeys(keys, c.MaxFields) {
+					m.RemoveField(key)
+				}
+			}
+		})
+		if truncated > 0 {
+			c.log.Debugf("Truncated tags or fields of %d metric(s) exceeding the limits", truncated)
+		}
+		return metrics
+	}
+
+	var dropped int
+	result := make([]telegraf.Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		if exceeds(metric) {
+			dropped++
+			continue
+		}
+		result = append(result, metric)
+	}
+	if dropped > 0 {
+		c.logErrorf("Dropped %d metric(s) exceeding the tag or field limits", dropped)
+		c.metrics.drop(dropDimensionLimit, dropped)
+	}
+	return result
+}
+
+// handleInvalidUTF8 scrubs or drops the metrics containing invalid UTF-8
+// according to the configured policy.
+func (c *httpClient) handleInvalidUTF8(metrics []telegraf.Metric) []telegraf.Metric {
+	if c.InvalidUTF8Policy == "scrub" {
+		metrics, scrubbed := copyOnWrite(metrics, hasInvalidUTF8, scrubUTF8)
+		if scrubbed > 0 {
+			c.log.Warnf("Replaced invalid UTF-8 in %d metric(s)", scrubbed)
+		}
+		return metrics
+	}
+
+	var dropped int
+	result := make([]telegraf.Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		if hasInvalidUTF8(metric) {
+			dropped++
+			continue
+		}
+		result = append(result, metric)
+	}
+	if dropped > 0 {
+		c.logErrorf("Dropped %d metric(s) containing invalid UTF-8", dropped)
+		c.metrics.drop(dropInvalidUTF8, dropped)
+	}
+	return result
+}
+
+// hasInvalidUTF8 returns true if the name, a tag or a field of the metric
+// is not valid UTF-8.
+func hasInvalidUTF8(m telegraf.Metric) bool {
+	if !utf8.ValidString(m.Name()) {
+		return true
+	}
+	for _, tag := range m.TagList() {
+		if !utf8.ValidString(tag.Key) || !utf8.ValidString(tag.Value) {
+			return true
+		}
+	}
+	for _, field := range m.FieldList() {
+		if !utf8.ValidString(field.Key) {
+			return true
+		}
+		if value, ok := field.Value.(string); ok && !utf8.ValidString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// scrubUTF8 replaces invalid UTF-8 in the name, tags and fields of the
+// metric with the Unicode replacement character.
+func scrubUTF8(m telegraf.Metric) {
+	scrub := func(s string) string {
+		return strings.ToValidUTF8(s, string(utf8.RuneError))
+	}
+
+	// Copy the lists as they are modified while iterating
+	tags := append([]*telegraf.Tag(nil), m.TagList()...)
+	fields := append([]*telegraf.Field(nil), m.FieldList()...)
+
+	m.SetName(scrub(m.Name()))
+	for _, tag := range tags {
+		if !utf8.ValidString(tag.Key) || !utf8.ValidString(tag.Value) {
+			m.RemoveTag(tag.Key)
+			m.AddTag(scrub(tag.Key), scrub(tag.Value))
+		}
+	}
+	for _, field := range fields {
+		value, isString := field.Value.(string)
+		if utf8.ValidString(field.Key) && (!isString || utf8.ValidString(value)) {
+			continue
+		}
+		m.RemoveField(field.Key)
+		if isString {
+			m.AddField(scrub(field.Key), scrub(value))
+		} else {
+			m.AddField(scrub(field.Key), field.Value)
+		}
+	}
+}
+
+// excessKeys returns the keys beyond the limit in lexical order.
+func excessKeys(keys []string, limit int) []string {
+	if len(keys) <= limit {
+		return nil
+	}
+	sort.Strings(keys)
+	return keys[limit:]
+}
+
+// dropFieldless removes metrics without fields as those cannot be serialized
+// to line protocol.
+func (c *httpClient) dropFieldless(metrics []telegraf.Metric) []telegraf.Metric {
+	var dropped int
+	for _, metric := range metrics {
+		if len(metric.FieldList()) == 0 {
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		return metrics
+	}
+
+	c.log.Debugf("Dropped %d metric(s) without fields", dropped)
+	c.metrics.drop(dropFieldless, dropped)
+
+	result := make([]telegraf.Metric, 0, len(metrics)-dropped)
+	for _, metric := range metrics {
+		if len(metric.FieldList()) > 0 {
+			result = append(result, metric)
+		}
+	}
+	return result
+}
+
+// clampFutureTimestamps replaces the timestamp of metrics lying further in the
+// future than the configured tolerance with the current time.
+func (c *httpClient) clampFutureTimestamps(metrics []telegraf.Metric) []telegraf.Metric {
+	now := time.Now()
+	limit := now.Add(c.FutureTimestampTolerance)
+
+	metrics, clamped := copyOnWrite(metrics,
+		func(m telegraf.Metric) bool { return m.Time().After(limit) },
+		func(m telegraf.Metric) { m.SetTime(now) },
+	)
+	if clamped > 0 {
+		c.log.Debugf("Clamped timestamps of %d metric(s) lying in the future", clamped)
+	}
+	return metrics
+}
+
+// roundTimestamps rounds the timestamp of the metrics to the configured
+// interval.
+func (c *httpClient) roundTimestamps(metrics []telegraf.Metric) []telegraf.Metric {
+	metrics, _ = copyOnWrite(metrics,
+		func(m telegraf.Metric) bool { return !m.Time().Equal(m.Time().Round(c.RoundTimestamps)) },
+		func(m telegraf.Metric) { m.SetTime(m.Time().Round(c.RoundTimestamps)) },
+	)
+	return metrics
+}
+
+// nudgeDuplicateTimestamps shifts the timestamps of metrics sharing series
+// and timestamp with an earlier metric until they are unique in the batch.
+func (c *httpClient) nudgeDuplicateTimestamps(metrics []telegraf.Metric) []telegraf.Metric {
+	seen := make(map[uint64]map[int64]bool)
+
+	// copyOnWrite modifies each metric right after matching it, so the new
+	// timestamp found during matching can be handed over.
+	var next time.Time
+	metrics, nudged := copyOnWrite(metrics,
+		func(m telegraf.Metric) bool {
+			timestamps, ok := seen[m.HashID()]
+			if !ok {
+				timestamps = make(map[int64]bool)
+				seen[m.HashID()] = timestamps
+			}
+
+			next = m.Time()
+			for timestamps[next.UnixNano()] {
+				next = next.Add(c.DuplicateTimestampOffset)
+			}
+			timestamps[next.UnixNano()] = true
+			return !next.Equal(m.Time())
+		},
+		func(m telegraf.Metric) { m.SetTime(next) },
+	)
+	if nudged > 0 {
+		c.log.Infof("Adjusted duplicate timestamps of %d metric(s)", nudged)
+	}
+	return metrics
+}
+
+// addHostnameTag adds the hostname tag to all metrics not having it yet.
+func (c *httpClient) addHostnameTag(metrics []telegraf.Metric) []telegraf.Metric {
+	metrics, _ = copyOnWrite(metrics,
+		func(m telegraf.Metric) bool { return !m.HasTag(c.HostnameTag) },
+		func(m telegraf.Metric) { m.AddTag(c.HostnameTag, c.hostname) },
+	)
+	return metrics
+}
+
+// tagRetryAttempt sets the retry attempt tag to the given number of failed
+// attempts of writing the batch.
+func (c *httpClient) tagRetryAttempt(metrics []telegraf.Metric, failed int) []telegraf.Metric {
+	attempt := strconv.Itoa(failed)
+	metrics, _ = copyOnWrite(metrics,
+		func(telegraf.Metric) bool { return true },
+		func(m telegraf.Metric) { m.AddTag(c.RetryAttemptTag, attempt) },
+	)
+	return metrics
+}
+
+// copyOnWrite applies modify to copies of the metrics selected by match, so
+// the original metrics stay untouched in case of a retry. The slice is only
+// copied if any metric matches. The number of modified metrics is returned.
+func copyOnWrite(metrics []telegraf.Metric, match func(telegraf.Metric) bool, modify func(telegraf.Metric)) ([]telegraf.Metric, int) {
+	var modified int
+	var result []telegraf.Metric
+	for i, metric := range metrics {
+		if !match(metric) {
+			if result != nil {
+				result = append(result, metric)
+			}
+			continue
+		}
+
+		if result == nil {
+			result = make([]telegraf.Metric, 0, len(metrics))
+			result = append(result, metrics[:i]...)
+		}
+
+		metric = metric.Copy()
+		metric.Accept()
+		modify(metric)
+		result = append(result, metric)
+		modified++
+	}
+
+	if modified == 0 {
+		return metrics, 0
+	}
+	return result, modified
+}
+
+// checkBucketName applies the invalid bucket policy to the given bucket
+// name. It returns the name to use and false if the metric should be dropped.
+func (c *httpClient) checkBucketName(bucket string) (string, bool) {
+	switch c.InvalidBucketPolicy {
+	case "drop":
+		return bucket, strings.IndexFunc(bucket, invalidBucketRune) < 0
+	case "sanitize":
+		return strings.Map(func(r rune) rune {
+			if invalidBucketRune(r) {
+				return '_'
+			}
+			return r
+		}, bucket), true
+	}
+	return bucket, true
+}
+
+func invalidBucketRune(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return false
+	case r == '.', r == '-', r == '_':
+		return false
+	}
+	return true
+}
+
+// writeBatches writes the metrics to the given bucket, small batches are
+// collected first if coalescing is enabled.
+func (c *httpClient) writeBatches(ctx context.Context, bucket string, metrics []telegraf.Metric) error {
+	if c.coalescer != nil {
+		var pending []uint64
+		metrics, pending = c.coalescer.add(bucket, metrics, c.serializedSize(metrics...))
+		defer c.pending.done(pending...)
+		if len(metrics) == 0 {
+			return nil
+		}
+	}
+	return c.sendBatches(ctx, bucket, metrics)
+}
+
+// sendBatches writes the metrics to the given bucket, splitting them into
+// multiple requests if they exceed the configured maximum batch size.
+func (c *httpClient) sendBatches(ctx context.Context, bucket string, metrics []telegraf.Metric) error {
+	if c.DropOutOfRetention {
+		metrics = c.dropOutOfRetention(ctx, bucket, metrics, time.Now())
+		if len(metrics) == 0 {
+			return nil
+		}
+	}
+
+	if c.OrderedWrites {
+		metrics = sortByTime(metrics)
+	}
+
+	if c.MaxBatchBytes <= 0 {
+		return c.writeOrSplitBatch(ctx, bucket, metrics)
+	}
+
+	for _, batch := range c.splitBySize(metrics) {
+		if err := c.writeOrSplitBatch(ctx, bucket, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOrSplitBatch writes the batch, splitting it in halves if the server
+// rejects it as too large.
+func (c *httpClient) writeOrSplitBatch(ctx context.Context, bucket string, metrics []telegraf.Metric) error {
+	err := c.writeBatch(ctx, bucket, metrics)
+	if isTooLargeError(err) {
+		return c.splitAndWriteBatch(ctx, bucket, metrics)
+	}
+	return err
+}
+
+// sortByTime returns a copy of the metrics stably sorted by timestamp.
+func sortByTime(metrics []telegraf.Metric) []telegraf.Metric {
+	sorted := make([]telegraf.Metric, len(metrics))
+	copy(sorted, metrics)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time().Before(sorted[j].Time())
+	})
+	return sorted
+}
+
+// splitBySize splits the metrics into consecutive chunks with a serialized
+// size of at most MaxBatchBytes. Metrics exceeding the limit on their own
+// are put in a chunk of their own.
+func (c *httpClient) splitBySize(metrics []telegraf.Metric) [][]telegraf.Metric {
+	var batches [][]telegraf.Metric
+	var start int
+	var size int64
+	for i, metric := range metrics {
+		n := c.serializedSize(metric)
+
+		if i > start && size+n > c.MaxBatchBytes {
+			batches = append(batches, metrics[start:i])
+			start = i
+			size = 0
+		}
+		size += n
+	}
+	if start < len(metrics) {
+		batches = append(batches, metrics[start:])
+	}
+	return batches
+}
+
+// serializedSize returns the size of the metrics in line protocol. Metrics
+// failing to serialize are skipped by the reader later on so are not counted.
+func (c *httpClient) serializedSize(metrics ...telegraf.Metric) int64 {
+	var size int64
+	for _, metric := range metrics {
+		if octets, err := c.serializer.Serialize(metric); err == nil {
+			size += int64(len(octets))
+		}
+	}
+	return size
+}
+
+// splitAndWriteBatch recursively splits a batch rejected as too large in
+// halves and writes them, until a single metric is left. A single metric
+// still too large is dropped, as retrying it would never succeed.
+func (c *httpClient) splitAndWriteBatch(ctx context.Context, bucket string, metrics []telegraf.Metric) error {
+	if len(metrics) <= 1 {
+		c.logErrorf("Failed to write metric to %s (will be dropped: a single metric exceeds the request size limit of the server)", bucket)
+		c.metrics.drop(dropRejectedTooLarge, len(metrics))
+		return nil
+	}
+
+	c.log.Warnf("Retrying write after splitting metric payload in half to reduce batch size")
+	midpoint := len(metrics) / 2
+
+	if err := c.writeOrSplitBatch(ctx, bucket, metrics[:midpoint]); err != nil {
+		return err
+	}
+
+	return c.writeOrSplitBatch(ctx, bucket, metrics[midpoint:])
+}
+
+func (c *httpClient) writeBatch(ctx context.Context, bucket string, metrics []telegraf.Metric) error {
+	if c.udpFallback == nil {
+		return c.sendOnce(ctx, bucket, metrics)
+	}
+
+	// Skip HTTP while waiting for the retry time unless probing
+	now := time.Now()
+	c.retryMu.Lock()
+	waiting := c.retryTime.After(now) && !c.probeDue(now)
+	c.retryMu.Unlock()
+	if c.udpFallbackActive() && waiting {
+		return c.writeUDPFallback(ctx, bucket, metrics)
+	}
+
+	err := c.sendOnce(ctx, bucket, metrics)
+	c.countHTTPFailure(err)
+	if err != nil && c.udpFallbackActive() {
+		if udpErr := c.writeUDPFallback(ctx, bucket, metrics); udpErr != nil {
+			return joinErrors([]error{err, udpErr})
+		}
+		return nil
+	}
+	return err
+}
+
+// sendOnce sends the batch, waiting for the result of an identical batch
+// already being sent instead if deduplication is enabled.
+func (c *httpClient) sendOnce(ctx context.Context, bucket string, metrics []telegraf.Metric) error {
+	if c.dedupe == nil {
+		return c.sendBatch(ctx, bucket, metrics)
+	}
+	return c.dedupe.do(c.batchKey(bucket, metrics), func() error {
+		return c.sendBatch(ctx, bucket, metrics)
+	})
+}
+
+func (c *httpClient) sendBatch(ctx context.Context, bucket string, metrics []telegraf.Metric) (err error) {
+	// The serialized batch is used for all size checks and the body, as
+	// serializing is expensive.
+	payload, err := c.serializeBody(metrics)
+	if err != nil {
+		return err
+	}
+
+	// Batches are identified as first sent, so resending a batch tagged as a
+	// retry keeps its identity.
+	var key [sha256.Size]byte
+	if c.attempts != nil || c.sequence != nil {
+		key = payloadKey(bucket, payload)
+	}
+	if c.attempts != nil {
+		if failed := c.attempts.number(key); failed > 0 {
+			metrics = c.tagRetryAttempt(metrics, failed)
+			if payload, err = c.serializeBody(metrics); err != nil {
+				return err
+			}
+		}
+		defer func() {
+			c.attempts.done(key, err)
+		}()
+	}
+	size := int64(len(payload))
+
+	// Never send a request without payload as compressing nothing still
+	// produces a body, which is rejected by some servers.
+	if c.writeFormat != "otlp" && size == 0 {
+		c.log.Debugf("Dropped %d metric(s) for %s, none could be serialized", len(metrics), bucket)
+		c.metrics.drop(dropUnserializable, len(metrics))
+		return nil
+	}
+
+	loc, err := c.writeURL(*c.url, bucket)
+	if err != nil {
+		return err
+	}
+
+	if c.requestRate != nil {
+		if err := c.requestRate.wait(ctx, 1); err != nil {
+			return err
+		}
+	}
+	if c.byteRate != nil {
+		if err := c.byteRate.wait(ctx, float64(size)); err != nil {
+			return err
+		}
+	}
+	if c.bucketRate != nil {
+		if err := c.bucketRate.wait(ctx, bucket); err != nil {
+			return err
+		}
+	}
+
+	if c.inflight != nil {
+		if err := c.inflight.acquire(ctx, size); err != nil {
+			return err
+		}
+		defer c.inflight.release(size)
+	}
+
+	if c.sink != nil {
+		return c.writeSink(ctx, bucket, len(metrics), payload)
+	}
+
+	reader, err := c.compressBody(bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	body := &bodyReader{ReadCloser: reader, tap: c.Tap}
+	defer func() { body.Close() }()
+	defer func() {
+		if tapErr := body.TapErr(); tapErr != nil {
+			c.log.Errorf("Writing request body of bucket %q to tap failed: %v", bucket, tapErr)
+		}
+	}()
+
+	req, err := c.makeWriteRequest(loc, bucket, body)
+	if err != nil {
+		return err
+	}
+
+	if c.sequence != nil {
+		seq := c.sequence.number(key)
+		defer func() {
+			c.sequence.done(key, seq, err)
+		}()
+		req.Header.Set(c.SequenceHeader, strconv.FormatUint(seq, 10))
+	}
+
+	var resp *http.Response
+	if c.OnDelivery != nil {
+		start := time.Now()
+		defer func() {
+			receipt := Receipt{
+				Bucket:  bucket,
+				Metrics: len(metrics),
+				Bytes:   body.BytesRead(),
+				Latency: time.Since(start),
+				Err:     err,
+			}
+			if resp != nil {
+				receipt.StatusCode = resp.StatusCode
+				receipt.RequestID = requestID(resp.Header)
+				if err == nil {
+					receipt.Warning = resp.Header.Get("X-Influx-Error")
+				}
+			}
+			c.OnDelivery(receipt)
+		}()
+	}
+	if c.OnWrite != nil {
+		start := time.Now()
+		defer func() {
+			stats := WriteStats{
+				Bucket:          bucket,
+				SerializedBytes: size,
+				CompressedBytes: body.BytesRead(),
+				Duration:        time.Since(start),
+				Err:             err,
+			}
+			if resp != nil {
+				stats.StatusCode = resp.StatusCode
+			}
+			c.OnWrite(stats)
+		}()
+	}
+
+	sent := time.Now()
+	var reused int32
+	resp, err = c.client.Do(req.WithContext(traceReuse(ctx, &reused)))
+	if err != nil && atomic.LoadInt32(&reused) != 0 && body.Err() == nil && isStaleConnError(err) {
+		// The idle connection went stale, resend once on a new connection.
+		// The tap already saw the body unless nothing was sent.
+		c.log.Debugf("Resending write to %s as the reused connection was closed: %v", bucket, err)
+		reader, rerr := c.compressBody(bytes.NewReader(payload))
+		if rerr != nil {
+			return rerr
+		}
+		tap := c.Tap
+		if body.BytesRead() > 0 {
+			tap = nil
+		}
+		body.Close()
+		body = &bodyReader{ReadCloser: reader, tap: tap}
+		req = req.Clone(ctx)
+		req.Body = body
+		resp, err = c.client.Do(req)
+	}
+	if c.compression != nil && err == nil {
+		c.compression.observe(time.Since(sent))
+	}
+	if c.latencies != nil {
+		c.latencies.observe(bucket, time.Since(sent))
+	}
+	if err != nil {
+		if bodyErr := body.Err(); bodyErr != nil {
+			return &BodyError{Err: bodyErr}
+		}
+		internal.OnClientError(c.client, err)
+		var tokenErr *oauth2.RetrieveError
+		if errors.As(err, &tokenErr) {
+			return fmt.Errorf("fetching OAuth2 token failed: %w", tokenErr)
+		}
+		return err
+	}
+	c.limitBody(resp)
+	defer resp.Body.Close()
+
+	// The server might respond before the body was sent completely, never
+	// consider a truncated body as delivered.
+	if bodyErr := body.Err(); bodyErr != nil {
+		return &BodyError{Err: bodyErr}
+	}
+
+	c.countStatusCode(resp.StatusCode)
+	c.recordServerVersion(resp.Header)
+	c.metrics.sentBytes.Add(float64(body.BytesRead()))
+
+	if resp.StatusCode == http.StatusAccepted && c.AckTimeout > 0 {
+		if err := c.waitForAck(ctx, bucket, resp); err != nil {
+			return err
+		}
+	}
+
+	switch resp.StatusCode {
+	case
+		// this is the expected response:
+		http.StatusNoContent,
+		// but if we get these we should still accept it as delivered:
+		http.StatusOK,
+		http.StatusCreated,
+		http.StatusAccepted,
+		http.StatusPartialContent,
+		http.StatusMultiStatus,
+		http.StatusAlreadyReported:
+		if xErr := resp.Header.Get("X-Influx-Error"); xErr != "" && c.SoftErrorPolicy == "warn" {
+			c.log.Warnf("Write to %s succeeded with error: %s", bucket, xErr)
+		}
+		c.retryMu.Lock()
+		c.retryCount = 0
+		c.retryMu.Unlock()
+		c.metrics.writes.Inc()
+		c.mirrorBatch(bucket, payload)
+		c.compareBatch(metrics)
+		c.deleteStale(ctx, bucket, metrics)
+		return nil
+	}
+
+	desc := errorDescription(resp)
+
+	if c.retryableStatusCodes[resp.StatusCode] {
+		return c.retryLater(resp, bucket, size, desc)
+	}
+
+	switch resp.StatusCode {
+	// request was too large, send back to try again
 	case http.StatusRequestEntityTooLarge:
-		c.log.Errorf("Failed to write metric to %s, request was too large (413)", bucket)
+		c.logErrorf("Failed to write metric to %s, request was too large (413)", bucket)
 		return &APIError{
 			StatusCode:  resp.StatusCode,
 			Title:       resp.Status,
@@ -298,26 +2528,35 @@ func (c *httpClient) writeBatch(ctx context.Context, bucket string, metrics []te
 		// Clients should *not* repeat the request and the metrics should be dropped.
 		http.StatusUnprocessableEntity,
 		http.StatusNotAcceptable:
-		c.log.Errorf("Failed to write metric to %s (will be dropped: %s): %s\n", bucket, resp.Status, desc)
+		c.logErrorf("Failed to write metric to %s (will be dropped: %s): %s", bucket, resp.Status, desc)
+		c.metrics.drop(rejectedReason(resp.StatusCode), len(metrics))
 		return nil
 	case http.StatusUnauthorized, http.StatusForbidden:
-		return fmt.Errorf("failed to write metric to %s (%s): %s", bucket, resp.Status, desc)
+		err := &AuthenticationError{APIError{
+			StatusCode:  resp.StatusCode,
+			Title:       resp.Status,
+			Description: desc,
+		}}
+		c.forgetOrgID(err)
+		return fmt.Errorf("failed to write metric to %s: %w", bucket, err)
 	case http.StatusTooManyRequests,
 		http.StatusServiceUnavailable,
 		http.StatusBadGateway,
 		http.StatusGatewayTimeout:
 		// ^ these handle the cases where the server is likely overloaded, and may not be able to say so.
-		c.retryCount++
-		retryDuration := c.getRetryDuration(resp.Header)
-		c.retryTime = time.Now().Add(retryDuration)
-		c.log.Warnf("Failed to write to %s; will retry in %s. (%s)\n", bucket, retryDuration, resp.Status)
-		return fmt.Errorf("waiting %s for server (%s) before sending metric again", retryDuration, bucket)
+		return c.retryLater(resp, bucket, size, desc)
+	}
+
+	// InfluxDB itself does not accept brotli, a decoding proxy is required.
+	if resp.StatusCode == http.StatusUnsupportedMediaType && c.ContentEncoding == "br" {
+		desc += "; the server does not support brotli, consider another content encoding"
 	}
 
 	// if it's any other 4xx code, the client should not retry as it's the client's mistake.
 	// retrying will not make the request magically work.
 	if len(resp.Status) > 0 && resp.Status[0] == '4' {
-		c.log.Errorf("Failed to write metric to %s (will be dropped: %s): %s\n", bucket, resp.Status, desc)
+		c.logErrorf("Failed to write metric to %s (will be dropped: %s): %s", bucket, resp.Status, desc)
+		c.metrics.drop(rejectedReason(resp.StatusCode), len(metrics))
 		return nil
 	}
 
@@ -334,6 +2573,279 @@ func (c *httpClient) writeBatch(ctx context.Context, bucket string, metrics []te
 	}
 }
 
+// wallNow returns the current time without its monotonic clock reading, so
+// the retry time is compared by wall clock. This way, waiting follows changes
+// of the clock and ends after a system suspend, during which the monotonic
+// clock stops on some platforms.
+func wallNow() time.Time {
+	return time.Now().Round(0)
+}
+
+// retryLater holds back writes after a response asking to retry, according
+// to the backoff or the response headers.
+func (c *httpClient) retryLater(resp *http.Response, bucket string, size int64, desc string) error {
+	if c.DisableRetries {
+		return &APIError{
+			StatusCode:  resp.StatusCode,
+			Title:       resp.Status,
+			Description: desc,
+		}
+	}
+	c.metrics.retries.Inc()
+
+	c.retryMu.Lock()
+	defer c.retryMu.Unlock()
+	if c.inMaintenance(resp) {
+		// Retrying is pointless during maintenance, wait for the fixed
+		// duration without increasing the backoff.
+		c.retryStart = wallNow()
+		c.retryTime = c.retryStart.Add(c.MaintenanceWait)
+		c.logWarnf("Server is in maintenance, waiting %s before writing to %s again", c.MaintenanceWait, bucket)
+		return fmt.Errorf("waiting %s for server (%s) in maintenance before sending metric again", c.MaintenanceWait, bucket)
+	}
+	c.retryCount++
+	retryDuration := c.getRetryDuration(resp.Header)
+	if c.RetrySizeThreshold > 0 {
+		retryDuration = c.scaleRetryDuration(retryDuration, size)
+	}
+	c.retryStart = wallNow()
+	c.retryTime = c.retryStart.Add(retryDuration)
+	c.logRetry(bucket, resp.StatusCode, retryDuration)
+	return fmt.Errorf("waiting %s for server (%s) before sending metric again", retryDuration, bucket)
+}
+
+func (c *httpClient) countStatusCode(code int) {
+	c.statsMu.Lock()
+	c.statusCodes[code]++
+	c.statsMu.Unlock()
+	c.metrics.countResponse(code)
+}
+
+// ServerVersion identifies the InfluxDB version of the server.
+type ServerVersion struct {
+	Version string
+	Build   string
+}
+
+// recordServerVersion keeps the server version announced in the response
+// headers, if any.
+func (c *httpClient) recordServerVersion(header http.Header) {
+	version := header.Get("X-Influxdb-Version")
+	if version == "" {
+		return
+	}
+	c.statsMu.Lock()
+	c.serverVersion = ServerVersion{Version: version, Build: header.Get("X-Influxdb-Build")}
+	c.statsMu.Unlock()
+}
+
+// ServerVersion returns the version last announced by the server. It is
+// empty until a response with version headers was received.
+func (c *httpClient) ServerVersion() ServerVersion {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	return c.serverVersion
+}
+
+// DetectServerVersion asks the server for its health and returns the
+// version it announces.
+func (c *httpClient) DetectServerVersion(ctx context.Context) (ServerVersion, error) {
+	if err := c.Ping(ctx); err != nil && !isAuthError(err) {
+		return ServerVersion{}, err
+	}
+	version := c.ServerVersion()
+	if version.Version == "" {
+		return version, errors.New("server did not announce its version")
+	}
+	return version, nil
+}
+
+// StatusCodes returns a snapshot of the number of write responses received
+// per HTTP status code.
+func (c *httpClient) StatusCodes() map[int]int64 {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+
+	snapshot := make(map[int]int64, len(c.statusCodes))
+	for code, count := range c.statusCodes {
+		snapshot[code] = count
+	}
+	return snapshot
+}
+
+// writeSink hands the serialized batch of the given number of metrics to
+// the configured sink, reporting it to the hooks like a write request.
+func (c *httpClient) writeSink(ctx context.Context, bucket string, count int, payload []byte) error {
+	start := time.Now()
+	err := c.sink.Write(ctx, bucket, payload)
+	if c.OnDelivery != nil {
+		c.OnDelivery(Receipt{
+			Bucket:  bucket,
+			Metrics: count,
+			Bytes:   int64(len(payload)),
+			Latency: time.Since(start),
+			Err:     err,
+		})
+	}
+	if c.OnWrite != nil {
+		c.OnWrite(WriteStats{
+			Bucket:          bucket,
+			SerializedBytes: int64(len(payload)),
+			CompressedBytes: int64(len(payload)),
+			Duration:        time.Since(start),
+			Err:             err,
+		})
+	}
+	return err
+}
+
+// inMaintenance returns true if the response signals a maintenance window.
+func (c *httpClient) inMaintenance(resp *http.Response) bool {
+	return c.MaintenanceHeader != "" &&
+		resp.StatusCode == http.StatusServiceUnavailable &&
+		resp.Header.Get(c.MaintenanceHeader) != ""
+}
+
+func (c *httpClient) logRetry(bucket string, statusCode int, retryDuration time.Duration) {
+	if l, ok := c.log.(StructuredLogger); ok {
+		l.Warnw("Failed to write, will retry",
+			"bucket", bucket,
+			"status", statusCode,
+			"retry_count", c.retryCount,
+			"wait_seconds", retryDuration.Seconds(),
+		)
+		return
+	}
+	c.logWarnf("Failed to write to %s; will retry in %s. (%d %s)", bucket, retryDuration, statusCode, http.StatusText(statusCode))
+}
+
+// InFlightBytes returns the uncompressed size of the requests currently being
+// sent. It is only tracked if a limit is configured and zero otherwise.
+func (c *httpClient) InFlightBytes() int64 {
+	if c.inflight == nil {
+		return 0
+	}
+	return c.inflight.current()
+}
+
+// QueueDepth returns the number of metrics currently pending delivery and the
+// age of the oldest of them.
+func (c *httpClient) QueueDepth() QueueStats {
+	return c.pending.stats(time.Now())
+}
+
+// mirrorBatch sends the body of a successfully written batch to the mirror
+// endpoint, if one is configured. The write is best-effort and happens in the
+// background so it never blocks or fails the primary write.
+func (c *httpClient) mirrorBatch(bucket string, body []byte) {
+	if c.mirrorClient == nil {
+		return
+	}
+
+	c.mirrorWG.Add(1)
+	go func() {
+		defer c.mirrorWG.Done()
+		if err := c.writeMirror(bucket, body); err != nil {
+			c.log.Warnf("Failed to write metrics to mirror %s: %v", c.mirrorURL.Redacted(), err)
+		}
+	}()
+}
+
+// compareBatch writes a copy of a successfully written batch serialized with
+// the comparison serializer to the comparison bucket, if configured. Only
+// sending happens in the background, as serializers are not thread-safe.
+func (c *httpClient) compareBatch(metrics []telegraf.Metric) {
+	if c.ComparisonSerializer == nil {
+		return
+	}
+
+	var body bytes.Buffer
+	for _, metric := range metrics {
+		octets, err := c.ComparisonSerializer.Serialize(metric)
+		if err != nil {
+			c.log.Debugf("Could not serialize metric for comparison: %v", err)
+			continue
+		}
+		body.Write(octets)
+	}
+	if body.Len() == 0 {
+		return
+	}
+
+	c.mirrorWG.Add(1)
+	go func() {
+		defer c.mirrorWG.Done()
+		if err := c.writeComparison(&body); err != nil {
+			c.log.Warnf("Failed to write metrics to comparison bucket %s: %v", c.ComparisonBucket, err)
+		}
+	}()
+}
+
+func (c *httpClient) writeComparison(body io.Reader) error {
+	loc, err := makeWriteURL(*c.url, c.WritePath, c.Organization, c.OrganizationID, c.ComparisonBucket, c.Precision)
+	if err != nil {
+		return err
+	}
+
+	reader, err := c.compressBody(body)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	req, err := c.makeWriteRequest(loc, c.ComparisonBucket, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		internal.OnClientError(c.client, err)
+		return err
+	}
+	c.limitBody(resp)
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response %s: %s", resp.Status, errorDescription(resp))
+	}
+	return nil
+}
+
+func (c *httpClient) writeMirror(bucket string, body []byte) error {
+	loc, err := c.writeURL(*c.mirrorURL, bucket)
+	if err != nil {
+		return err
+	}
+
+	reader, err := c.compressBody(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	req, err := c.makeWriteRequest(loc, bucket, reader)
+	if err != nil {
+		return err
+	}
+	for header, value := range c.mirrorHeaders {
+		req.Header.Set(header, value)
+	}
+
+	resp, err := c.mirrorClient.Do(req)
+	if err != nil {
+		internal.OnClientError(c.mirrorClient, err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return nil
+}
+
 // retryDuration takes the longer of the Retry-After header and our own back-off calculation
 func (c *httpClient) getRetryDuration(headers http.Header) time.Duration {
 	// basic exponential backoff (x^2)/40 (denominator to widen the slope)
@@ -353,13 +2865,72 @@ func (c *httpClient) getRetryDuration(headers http.Header) time.Duration {
 		}
 		// protect against excessively large retry-after
 		retryAfterHeader = math.Min(retryAfterHeader, defaultMaxWaitRetryAfterSeconds)
+		// spread the retries of multiple clients after the requested time
+		if c.RetryAfterJitter > 0 {
+			retryAfterHeader += rand.Float64() * c.RetryAfterJitter.Seconds()
+		}
 	}
 	// take the highest value of backoff and retry-after.
 	retry := math.Max(backoff, retryAfterHeader)
+	if c.MaxRetryWait > 0 {
+		retry = math.Min(retry, c.MaxRetryWait.Seconds())
+	}
 	return time.Duration(retry*1000) * time.Millisecond
 }
 
-func (c *httpClient) makeWriteRequest(address string, body io.Reader) (*http.Request, error) {
+// probeDue returns true if a probe write may be sent during the wait for the
+// retry time. The retry lock must be held.
+func (c *httpClient) probeDue(now time.Time) bool {
+	if c.RetryProbeFraction <= 0 || c.retryStart.IsZero() {
+		return false
+	}
+	wait := c.retryTime.Sub(c.retryStart)
+	probeTime := c.retryStart.Add(time.Duration(float64(wait) * c.RetryProbeFraction))
+	return !now.Before(probeTime)
+}
+
+// endProbe ends the wait for the retry time if the probe write started at the
+// given time succeeded. If it failed without the server asking to back off
+// again, the wait is restarted with its previous duration.
+func (c *httpClient) endProbe(start time.Time, err error) {
+	c.retryMu.Lock()
+	defer c.retryMu.Unlock()
+
+	switch {
+	case err == nil:
+		c.retryTime = time.Time{}
+	case c.retryStart.Before(start):
+		wait := c.retryTime.Sub(c.retryStart)
+		c.retryStart = wallNow()
+		c.retryTime = c.retryStart.Add(wait)
+	}
+}
+
+// scaleRetryDuration lengthens the retry duration for batches larger than the
+// size threshold, so huge payloads are not resent right away to a struggling
+// server. The result never exceeds the maximum backoff unless the server
+// requested a longer wait already.
+func (c *httpClient) scaleRetryDuration(d time.Duration, size int64) time.Duration {
+	if size <= c.RetrySizeThreshold {
+		return d
+	}
+
+	limit := time.Duration(defaultMaxWaitSeconds) * time.Second
+	if c.MaxRetryWait > 0 {
+		limit = c.MaxRetryWait
+	}
+	if d >= limit {
+		return d
+	}
+
+	scaled := time.Duration(float64(d) * float64(size) / float64(c.RetrySizeThreshold))
+	if scaled > limit {
+		return limit
+	}
+	return scaled
+}
+
+func (c *httpClient) makeWriteRequest(address, bucket string, body io.Reader) (*http.Request, error) {
 	var err error
 
 	req, err := http.NewRequest("POST", address, body)
@@ -367,51 +2938,645 @@ func (c *httpClient) makeWriteRequest(address string, body io.Reader) (*http.Req
 		return nil, err
 	}
 
-	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	switch {
+	case c.writeFormat == "otlp":
+		req.Header.Set("Content-Type", "application/x-protobuf")
+	case c.BodyContentType != "":
+		req.Header.Set("Content-Type", c.BodyContentType)
+	default:
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
 	c.addHeaders(req)
+	if auth, ok := c.bucketAuth[bucket]; ok {
+		req.Header.Set("Authorization", auth)
+	}
+	if priority := c.priority(bucket); priority != "" {
+		req.Header.Set(c.PriorityHeader, priority)
+	}
+
+	if c.ServerDryRun {
+		params := req.URL.Query()
+		params.Set("dryRun", "true")
+		req.URL.RawQuery = params.Encode()
+	}
+	c.encodeQuerySpaces(req)
 
-	if c.ContentEncoding == "gzip" {
-		req.Header.Set("Content-Encoding", "gzip")
+	switch encoding := c.contentEncoding(); encoding {
+	case "gzip", "br":
+		req.Header.Set("Content-Encoding", encoding)
 	}
 
 	return req, nil
 }
 
-// requestBodyReader warp io.Reader from influx.NewReader to io.ReadCloser, which is usefully to fast close the write
-// side of the connection in case of error
-func (c *httpClient) requestBodyReader(metrics []telegraf.Metric) (io.ReadCloser, error) {
-	reader := influx.NewReader(metrics, c.serializer)
+// priority returns the value of the priority header for writes to the given
+// bucket or an empty string if no header should be sent.
+func (c *httpClient) priority(bucket string) string {
+	if c.PriorityHeader == "" {
+		return ""
+	}
+	if priority, ok := c.BucketPriorities[bucket]; ok {
+		return priority
+	}
+	return c.Priority
+}
+
+// serializeBody returns the metrics serialized in the write format.
+func (c *httpClient) serializeBody(metrics []telegraf.Metric) ([]byte, error) {
+	if c.writeFormat == "otlp" {
+		return c.serializeOTLP(metrics)
+	}
+	return io.ReadAll(c.serializedReader(metrics))
+}
 
-	if c.ContentEncoding == "gzip" {
-		rc, err := internal.CompressWithGzip(reader)
+// compressBody applies the configured content encoding to the body.
+func (c *httpClient) compressBody(reader io.Reader) (io.ReadCloser, error) {
+	switch c.contentEncoding() {
+	case "gzip":
+		compress := c.gzipCompress
+		if compress == nil {
+			compress = compressWithGzip
+		}
+		rc, err := compress(reader, c.CompressionLevel)
 		if err != nil {
 			return nil, err
 		}
 
 		return rc, nil
+	case "br":
+		return compressWithBrotli(reader, c.BrotliQuality), nil
 	}
 
 	return io.NopCloser(reader), nil
 }
 
+// gzipWriters holds gzip writers for reuse across requests, as allocating
+// a writer for every request puts significant pressure on the GC. Writers
+// cannot change their level, so there is a pool per level starting at
+// gzip.HuffmanOnly.
+var gzipWriters [gzip.BestCompression - gzip.HuffmanOnly + 1]sync.Pool
+
+func init() {
+	for i := range gzipWriters {
+		level := i + gzip.HuffmanOnly
+		gzipWriters[i].New = func() interface{} {
+			w, _ := gzip.NewWriterLevel(io.Discard, level)
+			return w
+		}
+	}
+}
+
+// compressWithGzip returns a stream of gzip-compressed data read from the
+// given reader using a pooled writer, compression happens in the background.
+// The level must be valid for gzip.NewWriterLevel.
+func compressWithGzip(data io.Reader, level int) (io.ReadCloser, error) {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid gzip compression level %d", level)
+	}
+	pool := &gzipWriters[level-gzip.HuffmanOnly]
+
+	pipeReader, pipeWriter := io.Pipe()
+	gzipWriter := pool.Get().(*gzip.Writer)
+	gzipWriter.Reset(pipeWriter)
+
+	go func() {
+		_, err := io.Copy(gzipWriter, data)
+		if cerr := gzipWriter.Close(); err == nil {
+			err = cerr
+		}
+		pipeWriter.CloseWithError(err)
+
+		// Writes to the pipe only return once consumed or after the reader
+		// was closed, so the writer is not used by the body anymore.
+		gzipWriter.Reset(io.Discard)
+		pool.Put(gzipWriter)
+	}()
+
+	return pipeReader, nil
+}
+
+// serializedReader returns a reader of the serialized metrics. Line protocol
+// is streamed, other formats are serialized up front; in both cases metrics
+// failing to serialize are skipped.
+func (c *httpClient) serializedReader(metrics []telegraf.Metric) io.Reader {
+	if serializer, ok := c.serializer.(*influx.Serializer); ok {
+		return influx.NewReader(metrics, serializer)
+	}
+
+	var buf bytes.Buffer
+	for _, metric := range metrics {
+		octets, err := c.serializer.Serialize(metric)
+		if err != nil {
+			c.log.Debugf("Could not serialize metric: %v", err)
+			continue
+		}
+		buf.Write(octets)
+	}
+	return &buf
+}
+
+// compressWithBrotli returns a stream of brotli-compressed data read from the
+// given reader, compression happens in the background.
+func compressWithBrotli(data io.Reader, quality int) io.ReadCloser {
+	pipeReader, pipeWriter := io.Pipe()
+	brotliWriter := brotli.NewWriterLevel(pipeWriter, quality)
+
+	go func() {
+		_, err := io.Copy(brotliWriter, data)
+		if cerr := brotliWriter.Close(); err == nil {
+			err = cerr
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+
+	return pipeReader
+}
+
+// makeAPIRequest performs a request against the management API and decodes
+// the JSON response into the given value. Responses other than 200 OK are
+// returned as an APIError.
+func (c *httpClient) makeAPIRequest(ctx context.Context, method, address string, v interface{}) error {
+	req, err := http.NewRequest(method, address, nil)
+	if err != nil {
+		return err
+	}
+	c.addHeaders(req)
+	c.encodeQuerySpaces(req)
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		internal.OnClientError(c.client, err)
+		return err
+	}
+	c.limitBody(resp)
+	defer resp.Body.Close()
+	c.recordServerVersion(resp.Header)
+
+	if resp.StatusCode != http.StatusOK {
+		return &APIError{
+			StatusCode:  resp.StatusCode,
+			Title:       resp.Status,
+			Description: errorDescription(resp),
+		}
+	}
+
+	if v == nil {
+		// Drain the body to allow reusing the connection
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// orgIDCache holds the ID of the configured organization once looked up.
+type orgIDCache struct {
+	sync.Mutex
+	id string
+}
+
+// getOrgID returns the ID of the configured organization, looking it up on
+// first use. Concurrent callers wait for a single lookup.
+func (c *httpClient) getOrgID(ctx context.Context) (string, error) {
+	if c.OrganizationID != "" {
+		return c.OrganizationID, nil
+	}
+
+	c.orgID.Lock()
+	defer c.orgID.Unlock()
+
+	if c.orgID.id != "" {
+		return c.orgID.id, nil
+	}
+	id, err := c.lookupOrgID(ctx, c.CreateOrganization)
+	if err != nil {
+		return "", err
+	}
+	c.orgID.id = id
+	return id, nil
+}
+
+// forgetOrgID drops the cached organization ID if the server rejected the
+// credentials, as the token might have been moved to another organization.
+func (c *httpClient) forgetOrgID(err error) {
+	if !isAuthError(err) {
+		return
+	}
+	c.orgID.Lock()
+	c.orgID.id = ""
+	c.orgID.Unlock()
+}
+
+// findOrgID returns the ID of the configured organization like getOrgID, but
+// never creates the organization.
+func (c *httpClient) findOrgID(ctx context.Context) (string, error) {
+	if c.OrganizationID != "" {
+		return c.OrganizationID, nil
+	}
+
+	c.orgID.Lock()
+	defer c.orgID.Unlock()
+
+	if c.orgID.id != "" {
+		return c.orgID.id, nil
+	}
+	id, err := c.lookupOrgID(ctx, false)
+	if err != nil {
+		return "", err
+	}
+	c.orgID.id = id
+	return id, nil
+}
+
+// lookupOrgID looks up the ID of the configured organization, creating the
+// organization if it does not exist and create is set.
+func (c *httpClient) lookupOrgID(ctx context.Context, create bool) (string, error) {
+	loc, err := makeOrgIDURL(*c.url, c.OrgIDPath, c.Organization)
+	if err != nil {
+		return "", err
+	}
+
+	var orgs struct {
+		Orgs []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"orgs"`
+	}
+	if err := c.makeAPIRequest(ctx, "GET", loc, &orgs); err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden) {
+			return "", fmt.Errorf("failed to look up organization %q, the token may lack org-level read permissions: %w", c.Organization, err)
+		}
+		// Servers answer with 404 if no organization matches the name
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+			return "", fmt.Errorf("failed to look up organization %q: %w", c.Organization, err)
+		}
+	}
+
+	for _, org := range orgs.Orgs {
+		if org.Name == c.Organization {
+			return org.ID, nil
+		}
+	}
+	if create {
+		return c.createOrganization(ctx)
+	}
+	return "", fmt.Errorf("organization %q not found", c.Organization)
+}
+
+// createOrganization creates the configured organization and returns its ID.
+func (c *httpClient) createOrganization(ctx context.Context) (string, error) {
+	loc, err := makeCreateURL(*c.url, c.CreateOrgPath)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(map[string]string{"name": c.Organization})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", loc, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.addHeaders(req)
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		internal.OnClientError(c.client, err)
+		return "", fmt.Errorf("failed to create organization %q: %w", c.Organization, err)
+	}
+	c.limitBody(resp)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		err := &APIError{
+			StatusCode:  resp.StatusCode,
+			Title:       resp.Status,
+			Description: errorDescription(resp),
+		}
+		if isAuthError(err) {
+			return "", fmt.Errorf("failed to create organization %q, the token lacks permission to create organizations: %w", c.Organization, err)
+		}
+		return "", fmt.Errorf("failed to create organization %q: %w", c.Organization, err)
+	}
+
+	var org struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&org); err != nil {
+		return "", fmt.Errorf("failed to decode created organization %q: %w", c.Organization, err)
+	}
+	c.log.Infof("Created organization %q", c.Organization)
+	return org.ID, nil
+}
+
+// CertificateExpiry connects to the server and returns the expiry time of
+// the certificate it presents. A zero time is returned for servers not using
+// TLS. The connection does not go through a proxy and is closed right away.
+func (c *httpClient) CertificateExpiry(ctx context.Context) (time.Time, error) {
+	if c.url.Scheme != "https" {
+		return time.Time{}, nil
+	}
+
+	address := c.url.Host
+	if c.url.Port() == "" {
+		address = net.JoinHostPort(c.url.Hostname(), "443")
+	}
+
+	var cfg *tls.Config
+	if c.tlsConfig != nil {
+		cfg = c.tlsConfig.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = c.url.Hostname()
+	}
+
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: c.Timeout},
+		Config:    cfg,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	defer conn.Close()
+
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return time.Time{}, errors.New("server presented no certificate")
+	}
+	return certs[0].NotAfter, nil
+}
+
+// Warmup establishes a connection to the server, including the TLS handshake,
+// by querying the health endpoint. The connection is kept in the pool so the
+// first write does not pay the connection setup latency.
+func (c *httpClient) Warmup(ctx context.Context) error {
+	loc, err := makeHealthURL(*c.url)
+	if err != nil {
+		return err
+	}
+	return c.makeAPIRequest(ctx, "GET", loc, nil)
+}
+
+// ProbeContentEncoding asks the server for the content encodings it accepts
+// via the Accept-Encoding header of an OPTIONS response to the write
+// endpoint and switches to the best one supported by both sides. The
+// configured encoding is kept if the server does not advertise any encoding
+// or accepts any. The effective encoding is returned.
+func (c *httpClient) ProbeContentEncoding(ctx context.Context) (string, error) {
+	loc, err := c.writeURL(*c.url, c.Bucket)
+	if err != nil {
+		return c.ContentEncoding, err
+	}
+	// Probe with the query and credentials of a write to the bucket
+	req, err := c.makeWriteRequest(loc, c.Bucket, nil)
+	if err != nil {
+		return c.ContentEncoding, err
+	}
+	req.Method = http.MethodOptions
+	req.Header.Del("Content-Type")
+	req.Header.Del("Content-Encoding")
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		internal.OnClientError(c.client, err)
+		return c.ContentEncoding, err
+	}
+	c.limitBody(resp)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if encoding, ok := selectContentEncoding(resp.Header.Get("Accept-Encoding")); ok {
+		c.ContentEncoding = encoding
+	}
+	return c.ContentEncoding, nil
+}
+
+// selectContentEncoding returns the best supported encoding accepted
+// according to the given Accept-Encoding value, preferring stronger
+// compression. False is returned if the value gives no preference.
+func selectContentEncoding(accept string) (string, bool) {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if key, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.EqualFold(key, "q") {
+				if v, err := strconv.ParseFloat(value, 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if coding == "*" && q > 0 {
+			return "", false
+		}
+		accepted[coding] = q > 0
+	}
+	if len(accepted) == 0 {
+		return "", false
+	}
+
+	for _, encoding := range []string{"br", "gzip"} {
+		if accepted[encoding] {
+			return encoding, true
+		}
+	}
+	if identity, ok := accepted["identity"]; ok && !identity {
+		return "", false
+	}
+	return "identity", true
+}
+
+// ValidationReport holds the outcome of each check performed by Validate. A
+// nil error denotes a passed check.
+type ValidationReport struct {
+	Health       error
+	Organization error
+	Bucket       error
+
+	// WriteOnly is set if the token is not allowed to read the organization
+	// but the server accepts writes with it. Writing works in this case,
+	// only the checks for the organization and bucket cannot be done.
+	WriteOnly bool
+}
+
+// OK returns true if all checks passed.
+func (r ValidationReport) OK() bool {
+	return r.Health == nil && r.Organization == nil && r.Bucket == nil
+}
+
+// Validate checks that the server is reachable, that the token can read the
+// configured organization and that the default bucket exists. All checks are
+// performed, checks depending on a failed check are reported as skipped. A
+// missing organization is reported even if CreateOrganization is set.
+func (c *httpClient) Validate(ctx context.Context) ValidationReport {
+	var report ValidationReport
+
+	if err := c.Ping(ctx); err != nil {
+		report.Health = fmt.Errorf("server not healthy: %w", err)
+	}
+
+	orgID, err := c.findOrgID(ctx)
+	if err != nil {
+		report.Organization = err
+		report.Bucket = errors.New("skipped as organization lookup failed")
+		report.WriteOnly = isAuthError(err) && c.checkWriteAccess(ctx) == nil
+		return report
+	}
+
+	loc, err := makeBucketURL(*c.url, orgID, c.Bucket)
+	if err != nil {
+		report.Bucket = err
+		return report
+	}
+
+	var buckets struct {
+		Buckets []struct {
+			Name string `json:"name"`
+		} `json:"buckets"`
+	}
+	if err := c.makeAPIRequest(ctx, "GET", loc, &buckets); err != nil {
+		c.forgetOrgID(err)
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+			report.Bucket = fmt.Errorf("failed to look up bucket %q: %w", c.Bucket, err)
+			return report
+		}
+	}
+	for _, b := range buckets.Buckets {
+		if b.Name == c.Bucket {
+			return report
+		}
+	}
+	report.Bucket = fmt.Errorf("bucket %q not found", c.Bucket)
+
+	return report
+}
+
+// Ping checks that the server is reachable and healthy, allowing to fail
+// fast before the first write. Responses with 401 or 403 are returned as an
+// authentication error wrapping the APIError.
+func (c *httpClient) Ping(ctx context.Context) error {
+	loc, err := makeHealthURL(*c.url)
+	if err != nil {
+		return err
+	}
+
+	err = c.makeAPIRequest(ctx, "GET", loc, nil)
+	if isAuthError(err) {
+		return fmt.Errorf("failed to authenticate with %s: %w", c.url.Redacted(), err)
+	}
+	return err
+}
+
+// checkWriteAccess sends a write without any data to the default bucket.
+// Servers check the authorization before reading the body, so any response
+// other than 401, 403 or 404 shows the token may write to the bucket.
+func (c *httpClient) checkWriteAccess(ctx context.Context) error {
+	loc, err := makeWriteURL(*c.url, c.WritePath, c.Organization, c.OrganizationID, c.Bucket, "")
+	if err != nil {
+		return err
+	}
+
+	err = c.makeAPIRequest(ctx, "POST", loc, nil)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+			return err
+		}
+		return nil
+	}
+	return err
+}
+
+// encodeQuerySpaces switches the encoding of spaces in the query from "+" to
+// "%20" if configured. A literal "+" is always encoded as "%2B", so any "+"
+// left in the query denotes a space.
+func (c *httpClient) encodeQuerySpaces(req *http.Request) {
+	if c.QuerySpaceEncoding == "percent" {
+		req.URL.RawQuery = strings.ReplaceAll(req.URL.RawQuery, "+", "%20")
+	}
+}
+
 func (c *httpClient) addHeaders(req *http.Request) {
 	for header, value := range c.Headers {
 		req.Header.Set(header, value)
 	}
+	if c.AuthScheme == "basic" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+}
+
+// writeURL returns the address to write the metrics of the given bucket to
+// according to the write format.
+func (c *httpClient) writeURL(loc url.URL, bucket string) (string, error) {
+	if c.writeFormat == "otlp" {
+		return makeAPIURL(loc, otlpMetricsPath, nil)
+	}
+	return makeWriteURL(loc, c.WritePath, c.Organization, c.OrganizationID, bucket, c.Precision)
 }
 
-func makeWriteURL(loc url.URL, org, bucket string) (string, error) {
+// makeWriteURL returns the write address, the organization is referenced by
+// its ID if given.
+func makeWriteURL(loc url.URL, writePath, org, orgID, bucket, precision string) (string, error) {
 	params := url.Values{}
 	params.Set("bucket", bucket)
+	if orgID != "" {
+		params.Set("orgID", orgID)
+	} else {
+		params.Set("org", org)
+	}
+	if precision != "" {
+		params.Set("precision", precision)
+	}
+
+	return makeAPIURL(loc, writePath, params)
+}
+
+func makeOrgIDURL(loc url.URL, orgIDPath, org string) (string, error) {
+	params := url.Values{}
 	params.Set("org", org)
 
+	return makeAPIURL(loc, orgIDPath, params)
+}
+
+// makeCreateURL returns the address to create the organization at.
+func makeCreateURL(loc url.URL, createOrgPath string) (string, error) {
+	return makeAPIURL(loc, createOrgPath, nil)
+}
+
+func makeBucketURL(loc url.URL, orgID, bucket string) (string, error) {
+	params := url.Values{}
+	params.Set("orgID", orgID)
+	params.Set("name", bucket)
+
+	return makeAPIURL(loc, "/api/v2/buckets", params)
+}
+
+func makeHealthURL(loc url.URL) (string, error) {
+	return makeAPIURL(loc, "/health", nil)
+}
+
+func makeAPIURL(loc url.URL, apiPath string, params url.Values) (string, error) {
 	switch loc.Scheme {
 	case "unix":
+		// The path of unix URLs is the socket, an HTTP path prefix for
+		// proxied backends can be passed as the "path_prefix" parameter.
+		prefix := loc.Query().Get("path_prefix")
 		loc.Scheme = "http"
 		loc.Host = "127.0.0.1"
-		loc.Path = "/api/v2/write"
+		loc.Path = path.Join("/", prefix, apiPath)
 	case "http", "https":
-		loc.Path = path.Join(loc.Path, "/api/v2/write")
+		loc.Path = path.Join(loc.Path, apiPath)
 	default:
 		return "", fmt.Errorf("unsupported scheme: %q", loc.Scheme)
 	}
@@ -419,6 +3584,38 @@ func makeWriteURL(loc url.URL, org, bucket string) (string, error) {
 	return loc.String(), nil
 }
 
+// Flush sends all metrics held back by the client, such as coalesced
+// metrics, and waits for pending background writes, such as mirror writes,
+// to complete. The first error of sending the held back metrics is returned,
+// the metrics are dropped nevertheless.
+func (c *httpClient) Flush(ctx context.Context) error {
+	var err error
+	if c.coalescer != nil {
+		err = c.coalescer.flush(ctx)
+	}
+	c.mirrorWG.Wait()
+	if c.backfill != nil {
+		if backfillErr := c.backfill.Flush(ctx); backfillErr != nil && err == nil {
+			err = fmt.Errorf("backfill: %w", backfillErr)
+		}
+	}
+	return err
+}
+
 func (c *httpClient) Close() {
+	if c.coalescer != nil {
+		// Failed writes are logged when dropping the metrics
+		_ = c.coalescer.flush(context.Background())
+	}
 	c.client.CloseIdleConnections()
+	if c.backfill != nil {
+		c.backfill.Close()
+	}
+	if c.mirrorClient != nil {
+		c.mirrorWG.Wait()
+		c.mirrorClient.CloseIdleConnections()
+	}
+	if c.udpFallback != nil {
+		c.udpFallback.close()
+	}
 }
@@ -1,13 +1,26 @@
 package influxdb_v2
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/plugins/serializers/influx"
+	"github.com/influxdata/telegraf/testutil"
 )
 
 func genURL(u string) *url.URL {
@@ -17,18 +30,32 @@ func genURL(u string) *url.URL {
 
 func TestMakeWriteURL(t *testing.T) {
 	tests := []struct {
-		err bool
-		url *url.URL
-		act string
+		err  bool
+		url  *url.URL
+		path string
+		act  string
 	}{
 		{
 			url: genURL("http://localhost:9999"),
 			act: "http://localhost:9999/api/v2/write?bucket=telegraf&org=influx",
 		},
+		{
+			url:  genURL("http://localhost:9999/influxdb"),
+			path: "/custom/write",
+			act:  "http://localhost:9999/influxdb/custom/write?bucket=telegraf&org=influx",
+		},
 		{
 			url: genURL("unix://var/run/influxd.sock"),
 			act: "http://127.0.0.1/api/v2/write?bucket=telegraf&org=influx",
 		},
+		{
+			url: genURL("unix:///var/run/proxy.sock?path_prefix=/influxdb"),
+			act: "http://127.0.0.1/influxdb/api/v2/write?bucket=telegraf&org=influx",
+		},
+		{
+			url: genURL("unix:///var/run/proxy.sock?path_prefix=influxdb/v2/"),
+			act: "http://127.0.0.1/influxdb/v2/api/v2/write?bucket=telegraf&org=influx",
+		},
 		{
 			err: true,
 			url: genURL("udp://localhost:9999"),
@@ -36,7 +63,11 @@ func TestMakeWriteURL(t *testing.T) {
 	}
 
 	for i := range tests {
-		rURL, err := makeWriteURL(*tests[i].url, "influx", "telegraf")
+		writePath := tests[i].path
+		if writePath == "" {
+			writePath = defaultWritePath
+		}
+		rURL, err := makeWriteURL(*tests[i].url, writePath, "influx", "", "telegraf", "")
 		if !tests[i].err {
 			require.NoError(t, err)
 		} else {
@@ -49,6 +80,18 @@ func TestMakeWriteURL(t *testing.T) {
 	}
 }
 
+func TestMakeAPIURLUnixPathPrefix(t *testing.T) {
+	loc := genURL("unix:///var/run/proxy.sock?path_prefix=/influxdb")
+
+	orgURL, err := makeOrgIDURL(*loc, defaultOrgsPath, "influx")
+	require.NoError(t, err)
+	require.Equal(t, "http://127.0.0.1/influxdb/api/v2/orgs?org=influx", orgURL)
+
+	healthURL, err := makeHealthURL(*loc)
+	require.NoError(t, err)
+	require.Equal(t, "http://127.0.0.1/influxdb/health", healthURL)
+}
+
 func TestExponentialBackoffCalculation(t *testing.T) {
 	c := &httpClient{}
 	tests := []struct {
@@ -98,3 +141,1009 @@ func TestExponentialBackoffCalculationWithRetryAfter(t *testing.T) {
 		})
 	}
 }
+
+func TestClampFutureTimestamps(t *testing.T) {
+	c := &httpClient{
+		ClampFutureTimestamps:    true,
+		FutureTimestampTolerance: time.Minute,
+		log:                      testutil.Logger{},
+	}
+
+	past := time.Now().Add(-time.Hour)
+	withinTolerance := time.Now().Add(30 * time.Second)
+	future := time.Now().Add(time.Hour)
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, past),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 2}, withinTolerance),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 3}, future),
+	}
+
+	before := time.Now()
+	actual := c.clampFutureTimestamps(metrics)
+	require.Len(t, actual, 3)
+	require.Equal(t, past, actual[0].Time())
+	require.Equal(t, withinTolerance, actual[1].Time())
+	require.False(t, actual[2].Time().Before(before))
+	require.False(t, actual[2].Time().After(time.Now()))
+
+	// The original metrics must not be modified
+	require.Equal(t, future, metrics[2].Time())
+}
+
+func TestSplitBySize(t *testing.T) {
+	metrics := []telegraf.Metric{
+		// Each metric is serialized to "cpu value=1i 0\n" with 15 bytes
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 2}, time.Unix(0, 0)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 3}, time.Unix(0, 0)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 4}, time.Unix(0, 0)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 5}, time.Unix(0, 0)),
+	}
+
+	tests := []struct {
+		name     string
+		limit    int64
+		expected []int
+	}{
+		{
+			name:     "all in one",
+			limit:    1000,
+			expected: []int{5},
+		},
+		{
+			name:     "two per batch",
+			limit:    30,
+			expected: []int{2, 2, 1},
+		},
+		{
+			name:     "limit below metric size",
+			limit:    10,
+			expected: []int{1, 1, 1, 1, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &httpClient{
+				MaxBatchBytes: tt.limit,
+				serializer:    influx.NewSerializer(),
+			}
+
+			batches := c.splitBySize(metrics)
+			sizes := make([]int, 0, len(batches))
+			for _, batch := range batches {
+				sizes = append(sizes, len(batch))
+			}
+			require.Equal(t, tt.expected, sizes)
+		})
+	}
+}
+
+func TestErrorDescription(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		expected    string
+	}{
+		{
+			name:        "json error",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"code": "invalid", "message": "unable to parse"}`,
+			expected:    "invalid: unable to parse",
+		},
+		{
+			name:        "json error with trailing data",
+			contentType: "application/json",
+			body:        `{"code": "invalid", "message": "unable to parse"}` + "\r\n0\r\n\r\ngarbage",
+			expected:    "invalid: unable to parse",
+		},
+		{
+			name:     "json error without content type",
+			body:     `{"code": "invalid", "message": "unable to parse"}`,
+			expected: "invalid: unable to parse",
+		},
+		{
+			name:        "invalid json",
+			contentType: "application/json",
+			body:        "not json",
+			expected:    "400 Bad Request",
+		},
+		{
+			name:        "plain text",
+			contentType: "text/plain; charset=utf-8",
+			body:        "unable to parse\n",
+			expected:    "unable to parse",
+		},
+		{
+			name:        "empty plain text",
+			contentType: "text/plain",
+			expected:    "400 Bad Request",
+		},
+		{
+			name:     "empty body",
+			expected: "400 Bad Request",
+		},
+		{
+			name:        "unknown content type",
+			contentType: "application/octet-stream",
+			body:        "\x00\x01",
+			expected:    "400 Bad Request",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: http.StatusBadRequest,
+				Status:     "400 Bad Request",
+				Header:     http.Header{},
+				Body:       io.NopCloser(strings.NewReader(tt.body)),
+			}
+			if tt.contentType != "" {
+				resp.Header.Set("Content-Type", tt.contentType)
+			}
+			require.Equal(t, tt.expected, errorDescription(resp))
+		})
+	}
+}
+
+func TestRetryDurationCappedByMaxRetryWait(t *testing.T) {
+	c := &httpClient{
+		MaxRetryWait: 30 * time.Second,
+		retryCount:   100,
+	}
+	require.EqualValues(t, 30*time.Second, c.getRetryDuration(http.Header{}))
+
+	hdr := http.Header{}
+	hdr.Add("Retry-After", "600")
+	require.EqualValues(t, 30*time.Second, c.getRetryDuration(hdr))
+}
+
+func TestRetryTimeCappedOnWrite(t *testing.T) {
+	c := &httpClient{
+		MaxRetryWait: time.Minute,
+		retryTime:    time.Now().Add(time.Hour),
+	}
+	err := c.Write(context.Background(), nil)
+	require.EqualError(t, err, "retry time has not elapsed")
+	require.WithinDuration(t, time.Now().Add(time.Minute), c.retryTime, time.Second)
+}
+
+func TestRetryTimeWallClock(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}),
+	)
+	defer ts.Close()
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:          genURL(ts.URL),
+		Bucket:       "telegraf",
+		MaxRetryWait: time.Minute,
+		Log:          testutil.Logger{},
+	})
+	require.NoError(t, err)
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 42.0}, time.Unix(0, 0)),
+	}
+	require.Error(t, c.Write(context.Background(), metrics))
+
+	// The retry time carries no monotonic clock reading, so it is compared
+	// by wall clock
+	require.NotContains(t, c.retryTime.String(), "m=")
+	require.NotContains(t, c.retryStart.String(), "m=")
+
+	// Setting the clock back by an hour is equivalent to a retry time an
+	// hour later by wall clock, which is capped
+	c.retryTime = c.retryTime.Add(time.Hour)
+	var retryErr *RetryError
+	require.ErrorAs(t, c.Write(context.Background(), metrics), &retryErr)
+	require.WithinDuration(t, time.Now().Add(time.Minute), c.retryTime, time.Second)
+	require.NotContains(t, c.retryTime.String(), "m=")
+}
+
+func TestScaleRetryDuration(t *testing.T) {
+	c := &httpClient{
+		RetrySizeThreshold: 1000,
+	}
+	require.Equal(t, time.Second, c.scaleRetryDuration(time.Second, 1000))
+	require.Equal(t, 4*time.Second, c.scaleRetryDuration(time.Second, 4000))
+	require.Equal(t, 60*time.Second, c.scaleRetryDuration(time.Second, 1000000))
+	require.Equal(t, 120*time.Second, c.scaleRetryDuration(120*time.Second, 4000))
+
+	c.MaxRetryWait = 2 * time.Second
+	require.Equal(t, 2*time.Second, c.scaleRetryDuration(time.Second, 4000))
+}
+
+func TestRetryProbe(t *testing.T) {
+	status := http.StatusInternalServerError
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.ReadAll(r.Body)
+			w.WriteHeader(status)
+		}),
+	)
+	defer ts.Close()
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:                genURL(ts.URL),
+		Bucket:             "telegraf",
+		RetryProbeFraction: 0.5,
+	})
+	require.NoError(t, err)
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+	}
+
+	// Probing is not due before half of the wait passed
+	now := time.Now()
+	c.retryStart = now.Add(-4 * time.Second)
+	c.retryTime = now.Add(6 * time.Second)
+	require.EqualError(t, c.Write(context.Background(), metrics), "retry time has not elapsed")
+
+	// A failed probe restarts the wait
+	c.retryStart = now.Add(-6 * time.Second)
+	c.retryTime = now.Add(4 * time.Second)
+	require.Error(t, c.Write(context.Background(), metrics))
+	require.WithinDuration(t, time.Now().Add(10*time.Second), c.retryTime, time.Second)
+	require.EqualError(t, c.Write(context.Background(), metrics), "retry time has not elapsed")
+
+	// A successful probe ends the wait
+	status = http.StatusNoContent
+	c.retryStart = now.Add(-6 * time.Second)
+	c.retryTime = now.Add(4 * time.Second)
+	require.NoError(t, c.Write(context.Background(), metrics))
+	require.True(t, c.retryTime.IsZero())
+}
+
+func TestWriteMaintenanceWindow(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.ReadAll(r.Body)
+			w.Header().Set("X-Maintenance", "upgrade")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}),
+	)
+	defer ts.Close()
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:               genURL(ts.URL),
+		Bucket:            "telegraf",
+		MaintenanceHeader: "X-Maintenance",
+		MaintenanceWait:   30 * time.Minute,
+		Log:               testutil.Logger{},
+	})
+	require.NoError(t, err)
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+	}
+	require.Error(t, c.Write(context.Background(), metrics))
+	require.WithinDuration(t, time.Now().Add(30*time.Minute), c.retryTime, time.Second)
+	require.Zero(t, c.retryCount)
+}
+
+func TestWriteRetryableStatusCodes(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.ReadAll(r.Body)
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusRequestTimeout)
+		}),
+	)
+	defer ts.Close()
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+	}
+
+	// By default the batch is dropped
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:    genURL(ts.URL),
+		Bucket: "telegraf",
+		Log:    testutil.Logger{},
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.Write(context.Background(), metrics))
+	require.True(t, c.retryTime.IsZero())
+
+	c, err = NewHTTPClient(&HTTPConfig{
+		URL:                  genURL(ts.URL),
+		Bucket:               "telegraf",
+		RetryableStatusCodes: []int{http.StatusRequestTimeout},
+		Log:                  testutil.Logger{},
+	})
+	require.NoError(t, err)
+	require.Error(t, c.Write(context.Background(), metrics))
+	require.WithinDuration(t, time.Now().Add(time.Minute), c.retryTime, time.Second)
+	require.Equal(t, 1, c.retryCount)
+
+	_, err = NewHTTPClient(&HTTPConfig{
+		URL:                  genURL(ts.URL),
+		RetryableStatusCodes: []int{204},
+	})
+	require.ErrorContains(t, err, "invalid retryable status code")
+}
+
+func TestRetryAfterJitter(t *testing.T) {
+	c := &httpClient{
+		RetryAfterJitter: 5 * time.Second,
+	}
+
+	hdr := http.Header{}
+	hdr.Add("Retry-After", "10")
+	for i := 0; i < 100; i++ {
+		d := c.getRetryDuration(hdr)
+		require.GreaterOrEqual(t, d, 10*time.Second)
+		require.Less(t, d, 15*time.Second)
+	}
+
+	// Without header no jitter is applied
+	require.EqualValues(t, 0, c.getRetryDuration(http.Header{}))
+}
+
+func TestWriteDisableRetries(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}),
+	)
+	defer ts.Close()
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:            genURL(ts.URL),
+		Bucket:         "telegraf",
+		DisableRetries: true,
+	})
+	require.NoError(t, err)
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+	}
+	for i := 0; i < 2; i++ {
+		err = c.Write(context.Background(), metrics)
+		var apiErr *APIError
+		require.ErrorAs(t, err, &apiErr)
+		require.Equal(t, http.StatusTooManyRequests, apiErr.StatusCode)
+	}
+	require.True(t, c.retryTime.IsZero())
+	require.Zero(t, c.retryCount)
+}
+
+func TestRoundTimestamps(t *testing.T) {
+	c := &httpClient{
+		RoundTimestamps: 10 * time.Second,
+	}
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, time.Unix(14, 0)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 2}, time.Unix(15, 0)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 3}, time.Unix(20, 0)),
+	}
+
+	actual := c.roundTimestamps(metrics)
+	expected := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, time.Unix(10, 0)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 2}, time.Unix(20, 0)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 3}, time.Unix(20, 0)),
+	}
+	testutil.RequireMetricsEqual(t, expected, actual)
+
+	// The original metrics must not be modified
+	require.Equal(t, time.Unix(14, 0), metrics[0].Time())
+}
+
+func TestNudgeDuplicateTimestamps(t *testing.T) {
+	c := &httpClient{
+		DuplicateTimestampOffset: time.Nanosecond,
+		log:                      testutil.Logger{},
+	}
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 2}, time.Unix(0, 0)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 3}, time.Unix(0, 1)),
+		testutil.MustMetric("cpu", map[string]string{"host": "a"}, map[string]interface{}{"value": 4}, time.Unix(0, 0)),
+	}
+
+	actual := c.nudgeDuplicateTimestamps(metrics)
+	expected := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 2}, time.Unix(0, 1)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 3}, time.Unix(0, 2)),
+		testutil.MustMetric("cpu", map[string]string{"host": "a"}, map[string]interface{}{"value": 4}, time.Unix(0, 0)),
+	}
+	testutil.RequireMetricsEqual(t, expected, actual)
+
+	// The original metrics must not be modified
+	require.Equal(t, time.Unix(0, 0), metrics[1].Time())
+}
+
+func TestLimitDimensions(t *testing.T) {
+	metrics := []telegraf.Metric{
+		testutil.MustMetric(
+			"cpu",
+			map[string]string{"a": "1", "b": "2", "c": "3"},
+			map[string]interface{}{"value": 1},
+			time.Unix(0, 0),
+		),
+		testutil.MustMetric(
+			"cpu",
+			map[string]string{"a": "1"},
+			map[string]interface{}{"z": 1, "y": 2, "x": 3},
+			time.Unix(0, 0),
+		),
+		testutil.MustMetric(
+			"cpu",
+			map[string]string{"a": "1"},
+			map[string]interface{}{"value": 1},
+			time.Unix(0, 0),
+		),
+	}
+
+	tests := []struct {
+		policy   string
+		expected []telegraf.Metric
+	}{
+		{
+			policy: "drop",
+			expected: []telegraf.Metric{
+				testutil.MustMetric(
+					"cpu",
+					map[string]string{"a": "1"},
+					map[string]interface{}{"value": 1},
+					time.Unix(0, 0),
+				),
+			},
+		},
+		{
+			policy: "truncate",
+			expected: []telegraf.Metric{
+				testutil.MustMetric(
+					"cpu",
+					map[string]string{"a": "1", "b": "2"},
+					map[string]interface{}{"value": 1},
+					time.Unix(0, 0),
+				),
+				testutil.MustMetric(
+					"cpu",
+					map[string]string{"a": "1"},
+					map[string]interface{}{"x": 3, "y": 2},
+					time.Unix(0, 0),
+				),
+				testutil.MustMetric(
+					"cpu",
+					map[string]string{"a": "1"},
+					map[string]interface{}{"value": 1},
+					time.Unix(0, 0),
+				),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			c := &httpClient{
+				MaxTags:              2,
+				MaxFields:            2,
+				DimensionLimitPolicy: tt.policy,
+				log:                  testutil.Logger{},
+				metrics:              newClientMetrics(),
+			}
+
+			actual := c.limitDimensions(metrics)
+			testutil.RequireMetricsEqual(t, tt.expected, actual)
+
+			// The original metrics must not be modified
+			require.Len(t, metrics[0].TagList(), 3)
+			require.Len(t, metrics[1].FieldList(), 3)
+		})
+	}
+}
+
+func TestAddHostnameTag(t *testing.T) {
+	c := &httpClient{
+		HostnameTag: "host",
+		hostname:    "myhost",
+	}
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+		testutil.MustMetric("cpu", map[string]string{"host": "other"}, map[string]interface{}{"value": 2}, time.Unix(0, 0)),
+	}
+
+	actual := c.addHostnameTag(metrics)
+	expected := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{"host": "myhost"}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+		testutil.MustMetric("cpu", map[string]string{"host": "other"}, map[string]interface{}{"value": 2}, time.Unix(0, 0)),
+	}
+	testutil.RequireMetricsEqual(t, expected, actual)
+
+	// The original metrics must not be modified
+	require.False(t, metrics[0].HasTag("host"))
+}
+
+func TestTagRetryAttempt(t *testing.T) {
+	c := &httpClient{
+		RetryAttemptTag: "retry_attempt",
+	}
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+		testutil.MustMetric("cpu", map[string]string{"retry_attempt": "1"}, map[string]interface{}{"value": 2}, time.Unix(0, 0)),
+	}
+
+	actual := c.tagRetryAttempt(metrics, 2)
+	expected := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{"retry_attempt": "2"}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+		testutil.MustMetric("cpu", map[string]string{"retry_attempt": "2"}, map[string]interface{}{"value": 2}, time.Unix(0, 0)),
+	}
+	testutil.RequireMetricsEqual(t, expected, actual)
+
+	// The original metrics must not be modified
+	require.False(t, metrics[0].HasTag("retry_attempt"))
+}
+
+func TestWriteRetryAttemptPerBatch(t *testing.T) {
+	var mu sync.Mutex
+	failed := map[string]bool{}
+	var received []string
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			bucket := r.URL.Query().Get("bucket")
+
+			mu.Lock()
+			defer mu.Unlock()
+			received = append(received, string(body))
+			if bucket == "b" && !failed[bucket] {
+				failed[bucket] = true
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	)
+	defer ts.Close()
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:             genURL(ts.URL),
+		Bucket:          "telegraf",
+		BucketTag:       "bucket",
+		RetryAttemptTag: "attempt",
+		DisableRetries:  true,
+		Log:             testutil.Logger{},
+	})
+	require.NoError(t, err)
+
+	metric := func(bucket string, tags map[string]string) telegraf.Metric {
+		tags["bucket"] = bucket
+		return testutil.MustMetric("cpu", tags, map[string]interface{}{"value": 1}, time.Unix(0, 0))
+	}
+	last := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return received[len(received)-1]
+	}
+
+	// The batch of bucket b fails
+	require.Error(t, c.Write(context.Background(), []telegraf.Metric{metric("b", map[string]string{})}))
+
+	// Fresh batches are not tagged, user tags are kept
+	require.NoError(t, c.Write(context.Background(), []telegraf.Metric{metric("a", map[string]string{"attempt": "user"})}))
+	require.Equal(t, "cpu,attempt=user,bucket=a value=1i 0\n", last())
+
+	// Resending the failed batch tags it as retry
+	require.NoError(t, c.Write(context.Background(), []telegraf.Metric{metric("b", map[string]string{})}))
+	require.Equal(t, "cpu,attempt=1,bucket=b value=1i 0\n", last())
+
+	// The batch succeeded, so sending it again is a first attempt
+	require.NoError(t, c.Write(context.Background(), []telegraf.Metric{metric("b", map[string]string{})}))
+	require.Equal(t, "cpu,bucket=b value=1i 0\n", last())
+}
+
+func TestWriteCompressionFailure(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	)
+	defer ts.Close()
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:             genURL(ts.URL),
+		Bucket:          "telegraf",
+		ContentEncoding: "gzip",
+	})
+	require.NoError(t, err)
+
+	compressionErr := errors.New("out of memory")
+	c.gzipCompress = func(io.Reader, int) (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			_, _ = pw.Write([]byte{0x1f, 0x8b})
+			pw.CloseWithError(compressionErr)
+		}()
+		return pr, nil
+	}
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 42.0}, time.Unix(0, 0)),
+	}
+	err = c.Write(context.Background(), metrics)
+
+	var bodyErr *BodyError
+	require.ErrorAs(t, err, &bodyErr)
+	require.ErrorIs(t, err, compressionErr)
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("INFLUX_ORG", "myorg")
+	t.Setenv("INFLUX_ENV", "prod")
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:          genURL("http://localhost:8086"),
+		Organization: "${INFLUX_ORG}",
+		Bucket:       "telegraf-${INFLUX_ENV}",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "myorg", c.Organization)
+	require.Equal(t, "telegraf-prod", c.Bucket)
+
+	// Only the ${VAR} form is expanded
+	c, err = NewHTTPClient(&HTTPConfig{
+		URL:          genURL("http://localhost:8086"),
+		Organization: "$INFLUX_ORG",
+		Bucket:       "cost$-${INFLUX_ENV}-$",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "$INFLUX_ORG", c.Organization)
+	require.Equal(t, "cost$-prod-$", c.Bucket)
+
+	_, err = NewHTTPClient(&HTTPConfig{
+		URL:    genURL("http://localhost:8086"),
+		Bucket: "telegraf-${INFLUX_UNSET_VARIABLE}",
+	})
+	require.ErrorContains(t, err, "INFLUX_UNSET_VARIABLE")
+}
+
+func TestCheckBucketName(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		bucket     string
+		expected   string
+		expectedOK bool
+	}{
+		{name: "valid keep", policy: "keep", bucket: "my-bucket_1.0", expected: "my-bucket_1.0", expectedOK: true},
+		{name: "valid drop", policy: "drop", bucket: "my-bucket_1.0", expected: "my-bucket_1.0", expectedOK: true},
+		{name: "space keep", policy: "keep", bucket: "my bucket", expected: "my bucket", expectedOK: true},
+		{name: "space drop", policy: "drop", bucket: "my bucket", expectedOK: false},
+		{name: "space sanitize", policy: "sanitize", bucket: "my bucket", expected: "my_bucket", expectedOK: true},
+		{name: "slash drop", policy: "drop", bucket: "a/b", expectedOK: false},
+		{name: "slash sanitize", policy: "sanitize", bucket: "a/../b", expected: "a_.._b", expectedOK: true},
+		{name: "unicode drop", policy: "drop", bucket: "mesures-été", expectedOK: false},
+		{name: "unicode sanitize", policy: "sanitize", bucket: "mesures-été", expected: "mesures-_t_", expectedOK: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &httpClient{InvalidBucketPolicy: tt.policy}
+			bucket, ok := c.checkBucketName(tt.bucket)
+			require.Equal(t, tt.expectedOK, ok)
+			if ok {
+				require.Equal(t, tt.expected, bucket)
+			}
+		})
+	}
+}
+
+func TestCheckOrganization(t *testing.T) {
+	tests := []struct {
+		name         string
+		organization string
+		expectedErr  string
+	}{
+		{name: "plain", organization: "my-org"},
+		{name: "space", organization: "my org"},
+		{name: "unicode", organization: "société générale"},
+		{name: "slash", organization: "team/a", expectedErr: "reference the organization by ID"},
+		{name: "backslash", organization: `team\a`, expectedErr: "contains slashes"},
+		{name: "trailing space", organization: "my-org ", expectedErr: "whitespace"},
+		{name: "control", organization: "my\norg", expectedErr: "control characters"},
+		{name: "invalid utf8", organization: "my\xfforg", expectedErr: "not valid UTF-8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkOrganization(tt.organization)
+			if tt.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tt.expectedErr)
+			}
+		})
+	}
+}
+
+func TestOrganizationID(t *testing.T) {
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:            genURL("http://localhost:8086"),
+		Bucket:         "telegraf",
+		OrganizationID: "0123456789abcdef",
+	})
+	require.NoError(t, err)
+
+	loc, err := c.writeURL(*c.url, "telegraf")
+	require.NoError(t, err)
+	require.Equal(t, "http://localhost:8086/api/v2/write?bucket=telegraf&orgID=0123456789abcdef", loc)
+
+	orgID, err := c.getOrgID(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "0123456789abcdef", orgID)
+
+	_, err = NewHTTPClient(&HTTPConfig{
+		URL:            genURL("http://localhost:8086"),
+		Organization:   "influx",
+		OrganizationID: "0123456789abcdef",
+	})
+	require.ErrorContains(t, err, "cannot be combined")
+}
+
+func TestCreateOrganization(t *testing.T) {
+	var created []string
+	allowed := true
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/custom/create" && r.Method == http.MethodPost:
+				if !allowed {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				body, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				created = append(created, string(body))
+				w.WriteHeader(http.StatusCreated)
+				_, err = w.Write([]byte(`{"id": "5678", "name": "new"}`))
+				require.NoError(t, err)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	config := &HTTPConfig{
+		URL:                genURL(ts.URL),
+		Organization:       "new",
+		Bucket:             "telegraf",
+		CreateOrganization: true,
+		CreateOrgPath:      "/custom/create",
+		Log:                testutil.Logger{},
+	}
+	c, err := NewHTTPClient(config)
+	require.NoError(t, err)
+
+	// Looking up the ID without creating fails
+	_, err = c.findOrgID(context.Background())
+	require.ErrorContains(t, err, `organization "new" not found`)
+	require.Empty(t, created)
+
+	orgID, err := c.getOrgID(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "5678", orgID)
+	require.Equal(t, []string{`{"name":"new"}`}, created)
+
+	// The ID is cached, so use a new client to create the organization again
+	c, err = NewHTTPClient(config)
+	require.NoError(t, err)
+
+	allowed = false
+	_, err = c.getOrgID(context.Background())
+	require.ErrorContains(t, err, "lacks permission to create organizations")
+}
+
+func TestRemoveExcludedFields(t *testing.T) {
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:           genURL("http://localhost:8086"),
+		ExcludeFields: []string{"debug_*", "trace"},
+		Log:           testutil.Logger{},
+	})
+	require.NoError(t, err)
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric(
+			"cpu",
+			map[string]string{},
+			map[string]interface{}{"value": 1, "debug_info": "x", "debug_stack": "y", "trace": "z"},
+			time.Unix(0, 0),
+		),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 2}, time.Unix(0, 0)),
+	}
+
+	actual := c.removeExcludedFields(metrics)
+	expected := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 2}, time.Unix(0, 0)),
+	}
+	testutil.RequireMetricsEqual(t, expected, actual)
+
+	// The original metrics must not be modified
+	require.True(t, metrics[0].HasField("debug_info"))
+}
+
+func TestCompressWithGzip(t *testing.T) {
+	data := strings.Repeat("cpu value=42 0\n", 1000)
+
+	// Run repeatedly so writers are taken from the pool
+	for i := 0; i < 3; i++ {
+		rc, err := compressWithGzip(strings.NewReader(data), gzip.DefaultCompression)
+		require.NoError(t, err)
+		reader, err := gzip.NewReader(rc)
+		require.NoError(t, err)
+		actual, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, data, string(actual))
+		require.NoError(t, rc.Close())
+	}
+
+	// A body closed before being consumed must not break later requests
+	rc, err := compressWithGzip(strings.NewReader(data), gzip.DefaultCompression)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+
+	rc, err = compressWithGzip(strings.NewReader(data), gzip.DefaultCompression)
+	require.NoError(t, err)
+	reader, err := gzip.NewReader(rc)
+	require.NoError(t, err)
+	actual, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, data, string(actual))
+}
+
+func TestCompressWithGzipLevel(t *testing.T) {
+	data := strings.Repeat("cpu value=42 0\n", 1000)
+
+	sizes := make(map[int]int)
+	for _, level := range []int{gzip.HuffmanOnly, gzip.NoCompression, gzip.BestSpeed, gzip.BestCompression} {
+		rc, err := compressWithGzip(strings.NewReader(data), level)
+		require.NoError(t, err)
+		compressed, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		sizes[level] = len(compressed)
+
+		reader, err := gzip.NewReader(bytes.NewReader(compressed))
+		require.NoError(t, err)
+		actual, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, data, string(actual))
+	}
+
+	// Level 0 only adds the gzip framing
+	require.Greater(t, sizes[gzip.NoCompression], len(data))
+	require.Less(t, sizes[gzip.BestSpeed], len(data))
+	require.LessOrEqual(t, sizes[gzip.BestCompression], sizes[gzip.BestSpeed])
+
+	_, err := compressWithGzip(strings.NewReader(data), 10)
+	require.Error(t, err)
+	_, err = compressWithGzip(strings.NewReader(data), -3)
+	require.Error(t, err)
+}
+
+func TestCompressionLevel(t *testing.T) {
+	tests := []struct {
+		name     string
+		level    int
+		expected int
+		err      string
+	}{
+		{name: "unset", expected: gzip.DefaultCompression},
+		{name: "fastest", level: gzip.BestSpeed, expected: gzip.BestSpeed},
+		{name: "best", level: gzip.BestCompression, expected: gzip.BestCompression},
+		{name: "default", level: gzip.DefaultCompression, expected: gzip.DefaultCompression},
+		{name: "huffman only", level: gzip.HuffmanOnly, expected: gzip.HuffmanOnly},
+		{name: "too high", level: 12, err: "invalid compression level 12"},
+		{name: "too low", level: -5, err: "invalid compression level -5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewHTTPClient(&HTTPConfig{
+				URL:              genURL("http://localhost:8086"),
+				Bucket:           "telegraf",
+				ContentEncoding:  "gzip",
+				CompressionLevel: tt.level,
+				Log:              testutil.Logger{},
+			})
+			if tt.err != "" {
+				require.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, c.CompressionLevel)
+		})
+	}
+}
+
+func benchmarkCompress(b *testing.B, compress func(io.Reader) (io.ReadCloser, error)) {
+	data := []byte(strings.Repeat("cpu,host=localhost value=42 0\n", 1000))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rc, err := compress(bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, rc); err != nil {
+			b.Fatal(err)
+		}
+		rc.Close()
+	}
+}
+
+func BenchmarkCompressWithGzip(b *testing.B) {
+	benchmarkCompress(b, internal.CompressWithGzip)
+}
+
+func BenchmarkCompressWithGzipPooled(b *testing.B) {
+	benchmarkCompress(b, func(data io.Reader) (io.ReadCloser, error) {
+		return compressWithGzip(data, gzip.DefaultCompression)
+	})
+}
+
+func TestHandleInvalidUTF8(t *testing.T) {
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{"host": "a\xffb"}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 2, "msg": "ok"}, time.Unix(0, 0)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 3, "msg\xff": "x\xffy"}, time.Unix(0, 0)),
+	}
+
+	c := &httpClient{InvalidUTF8Policy: "scrub", log: testutil.Logger{}}
+	actual := c.handleInvalidUTF8(metrics)
+	expected := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{"host": "a\uFFFDb"}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 2, "msg": "ok"}, time.Unix(0, 0)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 3, "msg\uFFFD": "x\uFFFDy"}, time.Unix(0, 0)),
+	}
+	testutil.RequireMetricsEqual(t, expected, actual)
+
+	// The original metrics must not be modified
+	require.Equal(t, "a\xffb", metrics[0].Tags()["host"])
+
+	c = &httpClient{InvalidUTF8Policy: "drop", log: testutil.Logger{}, metrics: newClientMetrics()}
+	actual = c.handleInvalidUTF8(metrics)
+	testutil.RequireMetricsEqual(t, metrics[1:2], actual)
+}
+
+func TestSelectContentEncoding(t *testing.T) {
+	tests := []struct {
+		accept   string
+		expected string
+		ok       bool
+	}{
+		{accept: ""},
+		{accept: "*"},
+		{accept: "gzip", expected: "gzip", ok: true},
+		{accept: "gzip, br", expected: "br", ok: true},
+		{accept: "GZIP;q=0.5, br;q=0", expected: "gzip", ok: true},
+		{accept: "deflate", expected: "identity", ok: true},
+		{accept: "identity;q=0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			encoding, ok := selectContentEncoding(tt.accept)
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.expected, encoding)
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package influxdb_v2
+
+import (
+	"context"
+	"sync"
+)
+
+// byteLimiter bounds the number of bytes in flight. A request exceeding the
+// limit on its own is admitted if nothing else is in flight, so it cannot
+// block forever.
+type byteLimiter struct {
+	limit int64
+
+	sync.Mutex
+	inflight int64
+	released chan struct{}
+}
+
+// acquire waits until n bytes can be sent without exceeding the limit or the
+// context is done.
+func (l *byteLimiter) acquire(ctx context.Context, n int64) error {
+	for {
+		l.Lock()
+		if l.inflight == 0 || l.inflight+n <= l.limit {
+			l.inflight += n
+			l.Unlock()
+			return nil
+		}
+		if l.released == nil {
+			l.released = make(chan struct{})
+		}
+		released := l.released
+		l.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+func (l *byteLimiter) release(n int64) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.inflight -= n
+	if l.released != nil {
+		close(l.released)
+		l.released = nil
+	}
+}
+
+func (l *byteLimiter) current() int64 {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.inflight
+}
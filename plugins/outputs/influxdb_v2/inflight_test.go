@@ -0,0 +1,43 @@
+package influxdb_v2
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestByteLimiter(t *testing.T) {
+	l := &byteLimiter{limit: 100}
+	ctx := context.Background()
+
+	require.NoError(t, l.acquire(ctx, 60))
+	require.NoError(t, l.acquire(ctx, 40))
+	require.EqualValues(t, 100, l.current())
+
+	// Exceeding the limit blocks until bytes are released
+	acquired := make(chan error)
+	go func() {
+		acquired <- l.acquire(ctx, 50)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired bytes exceeding the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	l.release(60)
+	require.NoError(t, <-acquired)
+	require.EqualValues(t, 90, l.current())
+
+	// Waiting is aborted by the context
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, l.acquire(timeoutCtx, 50), context.DeadlineExceeded)
+
+	// Requests larger than the limit pass if nothing else is in flight
+	l.release(90)
+	require.NoError(t, l.acquire(ctx, 1000))
+	require.EqualValues(t, 1000, l.current())
+}
@@ -2,6 +2,7 @@
 package influxdb_v2
 
 import (
+	"compress/gzip"
 	"context"
 	_ "embed"
 	"errors"
@@ -12,8 +13,10 @@ import (
 
 	"github.com/influxdata/telegraf"
 	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/plugins/common/oauth"
 	"github.com/influxdata/telegraf/plugins/common/tls"
 	"github.com/influxdata/telegraf/plugins/outputs"
+	"github.com/influxdata/telegraf/plugins/serializers"
 	"github.com/influxdata/telegraf/plugins/serializers/influx"
 )
 
@@ -37,6 +40,7 @@ type Client interface {
 type InfluxDB struct {
 	URLs             []string          `toml:"urls"`
 	Token            string            `toml:"token"`
+	TokenFile        string            `toml:"token_file"`
 	Organization     string            `toml:"organization"`
 	Bucket           string            `toml:"bucket"`
 	BucketTag        string            `toml:"bucket_tag"`
@@ -47,7 +51,137 @@ type InfluxDB struct {
 	UserAgent        string            `toml:"user_agent"`
 	ContentEncoding  string            `toml:"content_encoding"`
 	UintSupport      bool              `toml:"influx_uint_support"`
+	MirrorURL        string            `toml:"mirror_url"`
+	MirrorToken      string            `toml:"mirror_token"`
+
+	ClampFutureTimestamps    bool            `toml:"clamp_future_timestamps"`
+	FutureTimestampTolerance config.Duration `toml:"future_timestamp_tolerance"`
+	RoundTimestamps          config.Duration `toml:"round_timestamps"`
+	NudgeDuplicateTimestamps bool            `toml:"nudge_duplicate_timestamps"`
+	DuplicateTimestampOffset config.Duration `toml:"duplicate_timestamp_offset"`
+
+	ValidateOnConnect bool `toml:"validate_on_connect"`
+	WarmupOnConnect   bool `toml:"warmup_on_connect"`
+
+	ProbeContentEncoding bool `toml:"probe_content_encoding"`
+	DetectServerVersion  bool `toml:"detect_server_version"`
+
+	CertificateExpiryWarning config.Duration `toml:"certificate_expiry_warning"`
+
+	TokenPrefix     string `toml:"token_prefix"`
+	OmitTokenPrefix bool   `toml:"omit_token_prefix"`
+
+	MaxBatchBytes    config.Size     `toml:"max_batch_bytes"`
+	MaxInFlightBytes config.Size     `toml:"max_in_flight_bytes"`
+	MaxRetryWait     config.Duration `toml:"max_retry_wait"`
+	BrotliQuality    int             `toml:"brotli_quality"`
+	CompressionLevel int             `toml:"compression_level"`
+
+	LogSuppressionWindow config.Duration `toml:"log_suppression_window"`
+	RetryAfterJitter     config.Duration `toml:"retry_after_jitter"`
+
+	HostnameTag  string `toml:"hostname_tag"`
+	ServerDryRun bool   `toml:"server_dry_run"`
+
+	RetryAttemptTag string `toml:"retry_attempt_tag"`
+
+	OrganizationID  string `toml:"organization_id"`
+	SoftErrorPolicy string `toml:"soft_error_policy"`
+
+	HeartbeatMeasurement string `toml:"heartbeat_measurement"`
+	InvalidBucketPolicy  string `toml:"invalid_bucket_policy"`
+	ReservedBucketPolicy string `toml:"reserved_bucket_policy"`
+	QuerySpaceEncoding   string `toml:"query_space_encoding"`
+
+	ExcludeFields []string `toml:"exclude_fields"`
+	WriteFormat   string   `toml:"write_format"`
+
+	PriorityHeader   string            `toml:"priority_header"`
+	Priority         string            `toml:"priority"`
+	BucketPriorities map[string]string `toml:"bucket_priorities"`
+
+	Precision      string `toml:"precision"`
+	DisableRetries bool   `toml:"disable_retries"`
+	DropUntagged   bool   `toml:"drop_untagged"`
+
+	RetryableStatusCodes []int `toml:"retryable_status_codes"`
+
+	FailFastOnAuthError bool        `toml:"fail_fast_on_auth_error"`
+	MaxResponseBodySize config.Size `toml:"max_response_body_size"`
+
+	AckTimeout  config.Duration `toml:"ack_timeout"`
+	AckInterval config.Duration `toml:"ack_interval"`
+
+	AdaptiveCompression    bool            `toml:"adaptive_compression"`
+	CompressionLatencyLow  config.Duration `toml:"compression_latency_low"`
+	CompressionLatencyHigh config.Duration `toml:"compression_latency_high"`
+
+	MeasurementBuckets map[string]string `toml:"measurement_buckets"`
+	FieldBuckets       map[string]string `toml:"field_buckets"`
+	RetrySizeThreshold config.Size       `toml:"retry_size_threshold"`
+	RetryProbeFraction float64           `toml:"retry_probe_fraction"`
+	BucketTokens       map[string]string `toml:"bucket_tokens"`
+
+	MaxIdleConnAge config.Duration `toml:"max_idle_connection_age"`
+	SequenceHeader string          `toml:"sequence_header"`
+
+	LatencyBuckets []config.Duration `toml:"latency_histogram_buckets"`
+	RetryStateFile string            `toml:"retry_state_file"`
+
+	DropOutOfRetention bool   `toml:"drop_out_of_retention"`
+	InvalidUTF8Policy  string `toml:"invalid_utf8_policy"`
+	CreateOrganization bool   `toml:"create_organization"`
+
+	MaxRequestsPerSecond float64     `toml:"max_requests_per_second"`
+	MaxBytesPerSecond    config.Size `toml:"max_bytes_per_second"`
+
+	MaxBucketRequestsPerSecond float64            `toml:"max_bucket_requests_per_second"`
+	BucketRequestsPerSecond    map[string]float64 `toml:"bucket_requests_per_second"`
+
+	UDPFallbackURL   string `toml:"udp_fallback_url"`
+	UDPFallbackAfter int    `toml:"udp_fallback_after"`
+
+	CoalesceWindow   config.Duration `toml:"coalesce_window"`
+	CoalesceMaxBytes config.Size     `toml:"coalesce_max_bytes"`
+
+	ComparisonBucket     string `toml:"comparison_bucket"`
+	ComparisonDataFormat string `toml:"comparison_data_format"`
+
+	MaxTags              int    `toml:"max_tags"`
+	MaxFields            int    `toml:"max_fields"`
+	DimensionLimitPolicy string `toml:"dimension_limit_policy"`
+
+	MaintenanceHeader string          `toml:"maintenance_header"`
+	MaintenanceWait   config.Duration `toml:"maintenance_wait"`
+
+	BackfillAge    config.Duration `toml:"backfill_age"`
+	BackfillURL    string          `toml:"backfill_url"`
+	BackfillBucket string          `toml:"backfill_bucket"`
+
+	DeleteBuckets   []string        `toml:"delete_buckets"`
+	DeletePredicate string          `toml:"delete_predicate"`
+	DeleteStart     config.Duration `toml:"delete_start"`
+	DeleteStop      config.Duration `toml:"delete_stop"`
+
+	HappyEyeballs bool `toml:"happy_eyeballs"`
+	HTTP2         bool `toml:"http2"`
+
+	MaxConcurrentBatches int `toml:"max_concurrent_batches"`
+
+	AuthScheme string `toml:"auth_scheme"`
+	Username   string `toml:"username"`
+	Password   string `toml:"password"`
+
+	WritePath     string `toml:"write_path"`
+	OrgIDPath     string `toml:"org_id_path"`
+	CreateOrgPath string `toml:"create_org_path"`
+
+	DeduplicateBatches bool `toml:"deduplicate_batches"`
+	MaxTrackedBatches  int  `toml:"max_tracked_batches"`
+	OrderedWrites      bool `toml:"ordered_writes"`
+
 	tls.ClientConfig
+	oauth.OAuth2Config
 
 	Log telegraf.Logger `toml:"-"`
 
@@ -63,6 +197,24 @@ func (i *InfluxDB) Connect() error {
 		i.URLs = append(i.URLs, defaultURL)
 	}
 
+	var mirror *url.URL
+	if len(i.MirrorURL) > 0 {
+		var err error
+		mirror, err = url.Parse(i.MirrorURL)
+		if err != nil {
+			return fmt.Errorf("error parsing mirror_url [%s]: %v", i.MirrorURL, err)
+		}
+	}
+
+	var backfill *url.URL
+	if len(i.BackfillURL) > 0 {
+		var err error
+		backfill, err = url.Parse(i.BackfillURL)
+		if err != nil {
+			return fmt.Errorf("error parsing backfill_url [%s]: %v", i.BackfillURL, err)
+		}
+	}
+
 	for _, u := range i.URLs {
 		parts, err := url.Parse(u)
 		if err != nil {
@@ -79,7 +231,7 @@ func (i *InfluxDB) Connect() error {
 
 		switch parts.Scheme {
 		case "http", "https", "unix":
-			c, err := i.getHTTPClient(parts, proxy)
+			c, err := i.getHTTPClient(parts, proxy, mirror, backfill)
 			if err != nil {
 				return err
 			}
@@ -120,7 +272,7 @@ func (i *InfluxDB) Write(metrics []telegraf.Metric) error {
 	return fmt.Errorf("failed to send metrics to any configured server(s)")
 }
 
-func (i *InfluxDB) getHTTPClient(address *url.URL, proxy *url.URL) (Client, error) {
+func (i *InfluxDB) getHTTPClient(address *url.URL, proxy *url.URL, mirror *url.URL, backfill *url.URL) (Client, error) {
 	tlsConfig, err := i.ClientConfig.TLSConfig()
 	if err != nil {
 		return nil, err
@@ -129,6 +281,7 @@ func (i *InfluxDB) getHTTPClient(address *url.URL, proxy *url.URL) (Client, erro
 	httpConfig := &HTTPConfig{
 		URL:              address,
 		Token:            i.Token,
+		TokenFile:        i.TokenFile,
 		Organization:     i.Organization,
 		Bucket:           i.Bucket,
 		BucketTag:        i.BucketTag,
@@ -139,8 +292,149 @@ func (i *InfluxDB) getHTTPClient(address *url.URL, proxy *url.URL) (Client, erro
 		UserAgent:        i.UserAgent,
 		ContentEncoding:  i.ContentEncoding,
 		TLSConfig:        tlsConfig,
-		Serializer:       i.newSerializer(),
-		Log:              i.Log,
+		MirrorURL:        mirror,
+		MirrorToken:      i.MirrorToken,
+
+		ClampFutureTimestamps:    i.ClampFutureTimestamps,
+		FutureTimestampTolerance: time.Duration(i.FutureTimestampTolerance),
+		RoundTimestamps:          time.Duration(i.RoundTimestamps),
+		NudgeDuplicateTimestamps: i.NudgeDuplicateTimestamps,
+		DuplicateTimestampOffset: time.Duration(i.DuplicateTimestampOffset),
+
+		TokenPrefix:     i.TokenPrefix,
+		OmitTokenPrefix: i.OmitTokenPrefix,
+
+		MaxBatchBytes:    int64(i.MaxBatchBytes),
+		MaxInFlightBytes: int64(i.MaxInFlightBytes),
+		MaxRetryWait:     time.Duration(i.MaxRetryWait),
+		BrotliQuality:    i.BrotliQuality,
+		CompressionLevel: i.CompressionLevel,
+
+		LogSuppressionWindow: time.Duration(i.LogSuppressionWindow),
+		RetryAfterJitter:     time.Duration(i.RetryAfterJitter),
+
+		HostnameTag:  i.HostnameTag,
+		ServerDryRun: i.ServerDryRun,
+
+		RetryAttemptTag: i.RetryAttemptTag,
+
+		OrganizationID:  i.OrganizationID,
+		SoftErrorPolicy: i.SoftErrorPolicy,
+
+		HeartbeatMeasurement: i.HeartbeatMeasurement,
+		InvalidBucketPolicy:  i.InvalidBucketPolicy,
+		ReservedBucketPolicy: i.ReservedBucketPolicy,
+		QuerySpaceEncoding:   i.QuerySpaceEncoding,
+
+		ExcludeFields: i.ExcludeFields,
+		WriteFormat:   i.WriteFormat,
+
+		PriorityHeader:   i.PriorityHeader,
+		Priority:         i.Priority,
+		BucketPriorities: i.BucketPriorities,
+
+		Precision:      i.Precision,
+		DisableRetries: i.DisableRetries,
+		DropUntagged:   i.DropUntagged,
+
+		RetryableStatusCodes: i.RetryableStatusCodes,
+
+		FailFastOnAuthError: i.FailFastOnAuthError,
+		MaxResponseBodySize: int64(i.MaxResponseBodySize),
+
+		AckTimeout:  time.Duration(i.AckTimeout),
+		AckInterval: time.Duration(i.AckInterval),
+
+		AdaptiveCompression:    i.AdaptiveCompression,
+		CompressionLatencyLow:  time.Duration(i.CompressionLatencyLow),
+		CompressionLatencyHigh: time.Duration(i.CompressionLatencyHigh),
+
+		MeasurementBuckets: i.MeasurementBuckets,
+		FieldBuckets:       i.FieldBuckets,
+		RetrySizeThreshold: int64(i.RetrySizeThreshold),
+		RetryProbeFraction: i.RetryProbeFraction,
+		BucketTokens:       i.BucketTokens,
+
+		MaxIdleConnAge: time.Duration(i.MaxIdleConnAge),
+		SequenceHeader: i.SequenceHeader,
+		RetryStateFile: i.RetryStateFile,
+
+		DropOutOfRetention: i.DropOutOfRetention,
+		InvalidUTF8Policy:  i.InvalidUTF8Policy,
+		CreateOrganization: i.CreateOrganization,
+
+		MaxRequestsPerSecond: i.MaxRequestsPerSecond,
+		MaxBytesPerSecond:    int64(i.MaxBytesPerSecond),
+
+		MaxBucketRequestsPerSecond: i.MaxBucketRequestsPerSecond,
+		BucketRequestsPerSecond:    i.BucketRequestsPerSecond,
+
+		UDPFallbackAfter: i.UDPFallbackAfter,
+
+		CoalesceWindow: time.Duration(i.CoalesceWindow),
+		CoalesceBytes:  int64(i.CoalesceMaxBytes),
+
+		MaxTags:              i.MaxTags,
+		MaxFields:            i.MaxFields,
+		DimensionLimitPolicy: i.DimensionLimitPolicy,
+
+		MaintenanceHeader: i.MaintenanceHeader,
+		MaintenanceWait:   time.Duration(i.MaintenanceWait),
+
+		BackfillAge:    time.Duration(i.BackfillAge),
+		BackfillURL:    backfill,
+		BackfillBucket: i.BackfillBucket,
+
+		DeleteBuckets:   i.DeleteBuckets,
+		DeletePredicate: i.DeletePredicate,
+		DeleteStart:     time.Duration(i.DeleteStart),
+		DeleteStop:      time.Duration(i.DeleteStop),
+
+		HappyEyeballs: i.HappyEyeballs,
+		HTTP2:         i.HTTP2,
+
+		MaxConcurrentBatches: i.MaxConcurrentBatches,
+
+		AuthScheme: i.AuthScheme,
+		Username:   i.Username,
+		Password:   i.Password,
+
+		WritePath:     i.WritePath,
+		OrgIDPath:     i.OrgIDPath,
+		CreateOrgPath: i.CreateOrgPath,
+
+		DeduplicateBatches: i.DeduplicateBatches,
+		MaxTrackedBatches:  i.MaxTrackedBatches,
+		OrderedWrites:      i.OrderedWrites,
+
+		OAuth2: i.OAuth2Config,
+
+		Serializer: i.newSerializer(),
+		Log:        i.Log,
+	}
+	if i.ComparisonBucket != "" {
+		dataFormat := i.ComparisonDataFormat
+		if dataFormat == "" {
+			dataFormat = "influx"
+		}
+		serializer, err := serializers.NewSerializer(&serializers.Config{
+			DataFormat:     dataFormat,
+			TimestampUnits: time.Nanosecond,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("comparison serializer: %w", err)
+		}
+		httpConfig.ComparisonSerializer = serializer
+		httpConfig.ComparisonBucket = i.ComparisonBucket
+	}
+	if i.UDPFallbackURL != "" {
+		httpConfig.UDPFallbackURL, err = url.Parse(i.UDPFallbackURL)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing udp_fallback_url [%s]: %v", i.UDPFallbackURL, err)
+		}
+	}
+	for _, bound := range i.LatencyBuckets {
+		httpConfig.LatencyBuckets = append(httpConfig.LatencyBuckets, time.Duration(bound))
 	}
 
 	c, err := NewHTTPClient(httpConfig)
@@ -148,6 +442,62 @@ func (i *InfluxDB) getHTTPClient(address *url.URL, proxy *url.URL) (Client, erro
 		return nil, fmt.Errorf("error creating HTTP client [%s]: %v", address, err)
 	}
 
+	if i.WarmupOnConnect {
+		if err := c.Warmup(context.Background()); err != nil {
+			i.Log.Warnf("Warming up connection to [%s] failed: %v", c.URL(), err)
+		}
+	}
+
+	if i.ProbeContentEncoding {
+		encoding, err := c.ProbeContentEncoding(context.Background())
+		if err != nil {
+			i.Log.Warnf("Probing content encodings of [%s] failed, using %q: %v", c.URL(), encoding, err)
+		} else {
+			i.Log.Debugf("Using content encoding %q for [%s]", encoding, c.URL())
+		}
+	}
+
+	if i.DetectServerVersion {
+		version, err := c.DetectServerVersion(context.Background())
+		if err != nil {
+			i.Log.Warnf("Detecting version of [%s] failed: %v", c.URL(), err)
+		} else {
+			i.Log.Infof("Server [%s] runs InfluxDB %s (build %s)", c.URL(), version.Version, version.Build)
+		}
+	}
+
+	if i.CertificateExpiryWarning > 0 {
+		expiry, err := c.CertificateExpiry(context.Background())
+		if err != nil {
+			i.Log.Warnf("Checking certificate of [%s] failed: %v", c.URL(), err)
+		} else if !expiry.IsZero() && time.Until(expiry) < time.Duration(i.CertificateExpiryWarning) {
+			i.Log.Warnf("Certificate of [%s] expires at %s", c.URL(), expiry.Format(time.RFC3339))
+		}
+	}
+
+	if i.CreateOrganization {
+		if _, err := c.getOrgID(context.Background()); err != nil {
+			i.Log.Errorf("Ensuring organization on [%s] exists failed: %v", c.URL(), err)
+		}
+	}
+
+	if i.ValidateOnConnect {
+		report := c.Validate(context.Background())
+		if report.Health != nil {
+			i.Log.Errorf("Validating [%s]: %v", c.URL(), report.Health)
+		}
+		if report.WriteOnly {
+			i.Log.Warnf("Validating [%s]: the token can write but not read organization %q, so the organization "+
+				"and bucket cannot be checked; grant read access to the organization or disable validate_on_connect",
+				c.URL(), i.Organization)
+		} else if report.Organization != nil {
+			i.Log.Errorf("Validating [%s]: %v", c.URL(), report.Organization)
+		}
+		if report.Bucket != nil && !report.WriteOnly {
+			i.Log.Errorf("Validating [%s]: %v", c.URL(), report.Bucket)
+		}
+	}
+
 	return c, nil
 }
 
@@ -163,8 +513,9 @@ func (i *InfluxDB) newSerializer() *influx.Serializer {
 func init() {
 	outputs.Add("influxdb_v2", func() telegraf.Output {
 		return &InfluxDB{
-			Timeout:         config.Duration(time.Second * 5),
-			ContentEncoding: "gzip",
+			Timeout:          config.Duration(time.Second * 5),
+			ContentEncoding:  "gzip",
+			CompressionLevel: gzip.DefaultCompression,
 		}
 	})
 }
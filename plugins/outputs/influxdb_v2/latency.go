@@ -0,0 +1,99 @@
+package influxdb_v2
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxLatencyBuckets limits the number of buckets with a latency histogram
+// of their own, writes to further buckets are recorded under an empty name.
+const maxLatencyBuckets = 100
+
+// LatencyHistogram holds the distribution of write request latencies.
+type LatencyHistogram struct {
+	// Bounds are the inclusive upper bounds of the histogram buckets in
+	// ascending order.
+	Bounds []time.Duration
+	// Counts holds the number of requests per histogram bucket. It has one
+	// entry more than Bounds for requests exceeding the largest bound.
+	Counts []uint64
+	// Count is the total number of requests.
+	Count uint64
+	// Sum is the total latency of all requests.
+	Sum time.Duration
+}
+
+func (h *LatencyHistogram) observe(latency time.Duration) {
+	i := sort.Search(len(h.Bounds), func(i int) bool { return latency <= h.Bounds[i] })
+	h.Counts[i]++
+	h.Count++
+	h.Sum += latency
+}
+
+// latencyRecorder tracks a latency histogram per bucket.
+type latencyRecorder struct {
+	bounds []time.Duration
+
+	sync.Mutex
+	histograms map[string]*LatencyHistogram
+}
+
+func newLatencyRecorder(bounds []time.Duration) *latencyRecorder {
+	sorted := make([]time.Duration, len(bounds))
+	copy(sorted, bounds)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return &latencyRecorder{
+		bounds:     sorted,
+		histograms: make(map[string]*LatencyHistogram),
+	}
+}
+
+func (r *latencyRecorder) observe(bucket string, latency time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	h, ok := r.histograms[bucket]
+	if !ok && len(r.histograms) >= maxLatencyBuckets {
+		bucket = ""
+		h, ok = r.histograms[bucket]
+	}
+	if !ok {
+		h = &LatencyHistogram{
+			Bounds: r.bounds,
+			Counts: make([]uint64, len(r.bounds)+1),
+		}
+		r.histograms[bucket] = h
+	}
+	h.observe(latency)
+}
+
+func (r *latencyRecorder) snapshot() map[string]LatencyHistogram {
+	r.Lock()
+	defer r.Unlock()
+
+	snapshot := make(map[string]LatencyHistogram, len(r.histograms))
+	for bucket, h := range r.histograms {
+		counts := make([]uint64, len(h.Counts))
+		copy(counts, h.Counts)
+		snapshot[bucket] = LatencyHistogram{
+			Bounds: h.Bounds,
+			Counts: counts,
+			Count:  h.Count,
+			Sum:    h.Sum,
+		}
+	}
+	return snapshot
+}
+
+// WriteLatencies returns a snapshot of the write request latency histograms
+// per bucket. Only the first 100 buckets written to have a histogram of
+// their own, the latencies of further buckets are recorded under an empty
+// name. Nil is returned if no histogram bounds are configured.
+func (c *httpClient) WriteLatencies() map[string]LatencyHistogram {
+	if c.latencies == nil {
+		return nil
+	}
+	return c.latencies.snapshot()
+}
@@ -0,0 +1,72 @@
+package influxdb_v2
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/testutil"
+)
+
+func TestLatencyRecorder(t *testing.T) {
+	r := newLatencyRecorder([]time.Duration{time.Second, 100 * time.Millisecond})
+	r.observe("telegraf", 50*time.Millisecond)
+	r.observe("telegraf", 100*time.Millisecond)
+	r.observe("telegraf", 500*time.Millisecond)
+	r.observe("telegraf", 2*time.Second)
+
+	expected := map[string]LatencyHistogram{
+		"telegraf": {
+			Bounds: []time.Duration{100 * time.Millisecond, time.Second},
+			Counts: []uint64{2, 1, 1},
+			Count:  4,
+			Sum:    2650 * time.Millisecond,
+		},
+	}
+	require.Equal(t, expected, r.snapshot())
+}
+
+func TestLatencyRecorderLimit(t *testing.T) {
+	r := newLatencyRecorder([]time.Duration{time.Second})
+	for i := 0; i < maxLatencyBuckets+10; i++ {
+		r.observe(fmt.Sprintf("bucket%d", i), time.Millisecond)
+	}
+
+	snapshot := r.snapshot()
+	require.Len(t, snapshot, maxLatencyBuckets+1)
+	require.Contains(t, snapshot, "bucket0")
+	require.NotContains(t, snapshot, fmt.Sprintf("bucket%d", maxLatencyBuckets))
+	require.EqualValues(t, 10, snapshot[""].Count)
+}
+
+func TestWriteLatencies(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	)
+	defer ts.Close()
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:            genURL(ts.URL),
+		Bucket:         "telegraf",
+		LatencyBuckets: []time.Duration{time.Minute},
+	})
+	require.NoError(t, err)
+	require.Empty(t, c.WriteLatencies())
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 42.0}, time.Unix(0, 0)),
+	}
+	require.NoError(t, c.Write(context.Background(), metrics))
+
+	latencies := c.WriteLatencies()
+	require.Contains(t, latencies, "telegraf")
+	require.Equal(t, []uint64{1, 0}, latencies["telegraf"].Counts)
+}
@@ -0,0 +1,75 @@
+package influxdb_v2
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// StructuredLogger is implemented by loggers supporting structured fields.
+// If the logger passed to the client implements it, retries are logged with
+// discrete fields instead of an interpolated message. Such messages are not
+// subject to repeat suppression.
+type StructuredLogger interface {
+	// Warnw logs a message with the given alternating keys and values.
+	Warnw(msg string, keysAndValues ...interface{})
+}
+
+// repeatFilter suppresses consecutive identical log messages within a time
+// window. Once the window expired, or the message changes, the number of
+// suppressed repetitions is reported.
+type repeatFilter struct {
+	window time.Duration
+
+	sync.Mutex
+	last       string
+	lastLogged time.Time
+	suppressed int
+}
+
+// filter returns the messages to log for the given message, which is empty
+// if the message should be suppressed.
+func (f *repeatFilter) filter(msg string, now time.Time) []string {
+	if f.window <= 0 {
+		return []string{msg}
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if msg == f.last {
+		if now.Sub(f.lastLogged) < f.window {
+			f.suppressed++
+			return nil
+		}
+
+		out := msg
+		if f.suppressed > 0 {
+			out = fmt.Sprintf("%s (still failing, repeated %d times)", msg, f.suppressed+1)
+		}
+		f.lastLogged = now
+		f.suppressed = 0
+		return []string{out}
+	}
+
+	var out []string
+	if f.suppressed > 0 {
+		out = append(out, fmt.Sprintf("Previous message repeated %d times: %s", f.suppressed, f.last))
+	}
+	f.last = msg
+	f.lastLogged = now
+	f.suppressed = 0
+	return append(out, msg)
+}
+
+func (c *httpClient) logErrorf(format string, args ...interface{}) {
+	for _, msg := range c.logFilter.filter(fmt.Sprintf(format, args...), time.Now()) {
+		c.log.Error(msg)
+	}
+}
+
+func (c *httpClient) logWarnf(format string, args ...interface{}) {
+	for _, msg := range c.logFilter.filter(fmt.Sprintf(format, args...), time.Now()) {
+		c.log.Warn(msg)
+	}
+}
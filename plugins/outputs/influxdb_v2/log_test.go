@@ -0,0 +1,67 @@
+package influxdb_v2
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf/testutil"
+)
+
+func TestRepeatFilter(t *testing.T) {
+	f := &repeatFilter{window: time.Minute}
+	now := time.Unix(0, 0)
+
+	require.Equal(t, []string{"a"}, f.filter("a", now))
+	require.Empty(t, f.filter("a", now.Add(10*time.Second)))
+	require.Empty(t, f.filter("a", now.Add(20*time.Second)))
+
+	// Window expired, the message is logged with the repetition count
+	require.Equal(t, []string{"a (still failing, repeated 3 times)"}, f.filter("a", now.Add(time.Minute)))
+	require.Empty(t, f.filter("a", now.Add(70*time.Second)))
+
+	// Changing messages are logged immediately
+	require.Equal(t,
+		[]string{"Previous message repeated 1 times: a", "b"},
+		f.filter("b", now.Add(80*time.Second)),
+	)
+	require.Equal(t, []string{"a"}, f.filter("a", now.Add(90*time.Second)))
+}
+
+func TestRepeatFilterDisabled(t *testing.T) {
+	f := &repeatFilter{}
+	now := time.Unix(0, 0)
+
+	require.Equal(t, []string{"a"}, f.filter("a", now))
+	require.Equal(t, []string{"a"}, f.filter("a", now))
+}
+
+type structuredLogger struct {
+	testutil.Logger
+	msg    string
+	fields []interface{}
+}
+
+func (l *structuredLogger) Warnw(msg string, keysAndValues ...interface{}) {
+	l.msg = msg
+	l.fields = keysAndValues
+}
+
+func TestLogRetryStructured(t *testing.T) {
+	logger := &structuredLogger{}
+	c := &httpClient{
+		retryCount: 3,
+		log:        logger,
+	}
+
+	c.logRetry("telegraf", http.StatusServiceUnavailable, 1500*time.Millisecond)
+	require.Equal(t, "Failed to write, will retry", logger.msg)
+	require.Equal(t, []interface{}{
+		"bucket", "telegraf",
+		"status", http.StatusServiceUnavailable,
+		"retry_count", 3,
+		"wait_seconds", 1.5,
+	}, logger.fields)
+}
@@ -0,0 +1,61 @@
+package influxdb_v2
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/influxdata/influxdb-observability/common"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+
+	"github.com/influxdata/telegraf"
+)
+
+const otlpMetricsPath = "/v1/metrics"
+
+// otlpLogger adapts the telegraf logger to the one used by the converter.
+type otlpLogger struct {
+	telegraf.Logger
+}
+
+func (l otlpLogger) Debug(msg string, kv ...interface{}) {
+	if l.Logger == nil {
+		return
+	}
+	format := msg + strings.Repeat(" %s=%q", len(kv)/2)
+	l.Logger.Debugf(format, kv...)
+}
+
+// serializeOTLP converts the metrics into an OTLP export request in protobuf
+// encoding. Tags become attributes, fields become data points.
+func (c *httpClient) serializeOTLP(metrics []telegraf.Metric) ([]byte, error) {
+	batch := c.otlpConverter.NewBatch()
+	for _, metric := range metrics {
+		var vType common.InfluxMetricValueType
+		switch metric.Type() {
+		case telegraf.Gauge:
+			vType = common.InfluxMetricValueTypeGauge
+		case telegraf.Untyped:
+			vType = common.InfluxMetricValueTypeUntyped
+		case telegraf.Counter:
+			vType = common.InfluxMetricValueTypeSum
+		case telegraf.Histogram:
+			vType = common.InfluxMetricValueTypeHistogram
+		case telegraf.Summary:
+			vType = common.InfluxMetricValueTypeSummary
+		default:
+			c.log.Warnf("Unrecognized metric type %v", metric.Type())
+			continue
+		}
+		err := batch.AddPoint(metric.Name(), metric.Tags(), metric.Fields(), metric.Time(), vType)
+		if err != nil {
+			c.log.Warnf("Failed to convert metric to OTLP: %v", err)
+			continue
+		}
+	}
+
+	octets, err := pmetricotlp.NewRequestFromMetrics(batch.GetMetrics()).MarshalProto()
+	if err != nil {
+		return nil, fmt.Errorf("marshalling OTLP request failed: %w", err)
+	}
+	return octets, nil
+}
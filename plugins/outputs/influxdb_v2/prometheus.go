@@ -0,0 +1,136 @@
+package influxdb_v2
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Reasons for dropping metrics. Metrics filtered by the client are counted
+// with the plain reason, metrics rejected by the server with the "rejected_"
+// prefix.
+const (
+	dropInvalidBucket   = "invalid_bucket"
+	dropReservedBucket  = "reserved_bucket"
+	dropUntagged        = "untagged"
+	dropDimensionLimit  = "dimension_limit"
+	dropInvalidUTF8     = "invalid_utf8"
+	dropFieldless       = "fieldless"
+	dropUnserializable  = "unserializable"
+	dropOutOfRetention  = "out_of_retention"
+	dropCoalesceFailure = "coalesce_failure"
+
+	dropRejectedMalformed     = "rejected_malformed"
+	dropRejectedNotAcceptable = "rejected_not_acceptable"
+	dropRejectedTooLarge      = "rejected_too_large"
+	dropRejectedUnprocessable = "rejected_unprocessable"
+	dropRejectedClientError   = "rejected_client_error"
+)
+
+// clientMetrics are the counters of the client exposed in Prometheus format.
+type clientMetrics struct {
+	registry *prometheus.Registry
+
+	writes    prometheus.Counter
+	dropped   *prometheus.CounterVec
+	retries   prometheus.Counter
+	sentBytes prometheus.Counter
+	responses *prometheus.CounterVec
+
+	deleteFailures prometheus.Counter
+
+	// droppedMu guards droppedByReason, which mirrors the dropped counter
+	// for DroppedMetrics.
+	droppedMu       sync.Mutex
+	droppedByReason map[string]uint64
+}
+
+func newClientMetrics() *clientMetrics {
+	m := &clientMetrics{
+		registry: prometheus.NewRegistry(),
+		writes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "influxdb_v2_writes_total",
+			Help: "Number of successful write requests.",
+		}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "influxdb_v2_dropped_metrics_total",
+			Help: "Number of metrics dropped without being written per reason.",
+		}, []string{"reason"}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "influxdb_v2_retries_total",
+			Help: "Number of writes deferred because the server asked to back off.",
+		}),
+		sentBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "influxdb_v2_sent_bytes_total",
+			Help: "Number of request body bytes sent for writes, after compression.",
+		}),
+		responses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "influxdb_v2_responses_total",
+			Help: "Number of write responses per HTTP status code.",
+		}, []string{"code"}),
+		deleteFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "influxdb_v2_delete_failures_total",
+			Help: "Number of failed deletes of stale data after writes.",
+		}),
+		droppedByReason: make(map[string]uint64),
+	}
+	m.registry.MustRegister(m.writes, m.dropped, m.retries, m.sentBytes, m.responses, m.deleteFailures)
+	return m
+}
+
+func (m *clientMetrics) countResponse(code int) {
+	m.responses.WithLabelValues(strconv.Itoa(code)).Inc()
+}
+
+// drop counts n metrics dropped for the given reason.
+func (m *clientMetrics) drop(reason string, n int) {
+	if n <= 0 {
+		return
+	}
+	m.dropped.WithLabelValues(reason).Add(float64(n))
+
+	m.droppedMu.Lock()
+	m.droppedByReason[reason] += uint64(n)
+	m.droppedMu.Unlock()
+}
+
+// rejectedReason returns the drop reason for metrics rejected by the server
+// with the given status code.
+func rejectedReason(code int) string {
+	switch code {
+	case http.StatusBadRequest:
+		return dropRejectedMalformed
+	case http.StatusNotAcceptable:
+		return dropRejectedNotAcceptable
+	case http.StatusRequestEntityTooLarge:
+		return dropRejectedTooLarge
+	case http.StatusUnprocessableEntity:
+		return dropRejectedUnprocessable
+	}
+	return dropRejectedClientError
+}
+
+// DroppedMetrics returns a snapshot of the number of metrics dropped so far
+// per reason. Reasons prefixed with "rejected_" count metrics rejected by the
+// server, all others metrics filtered by the client.
+func (c *httpClient) DroppedMetrics() map[string]uint64 {
+	m := c.metrics
+	m.droppedMu.Lock()
+	defer m.droppedMu.Unlock()
+
+	snapshot := make(map[string]uint64, len(m.droppedByReason))
+	for reason, n := range m.droppedByReason {
+		snapshot[reason] = n
+	}
+	return snapshot
+}
+
+// MetricsHandler returns a handler serving the counters of the client in
+// Prometheus exposition format. Mount it wherever convenient, e.g. at
+// "/metrics"; the counters are only exposed if the handler is served.
+func (c *httpClient) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(c.metrics.registry, promhttp.HandlerOpts{})
+}
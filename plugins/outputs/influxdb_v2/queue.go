@@ -0,0 +1,65 @@
+package influxdb_v2
+
+import (
+	"sync"
+	"time"
+)
+
+// QueueStats describes the metrics accepted by the client but not yet
+// delivered or dropped.
+type QueueStats struct {
+	// Metrics is the number of pending metrics.
+	Metrics int
+	// OldestAge is the time the oldest pending metric is waiting for.
+	OldestAge time.Duration
+}
+
+type pendingEntry struct {
+	metrics int
+	since   time.Time
+}
+
+// pendingQueue keeps track of the metrics currently pending delivery.
+type pendingQueue struct {
+	sync.Mutex
+	next    uint64
+	entries map[uint64]pendingEntry
+}
+
+// add registers the given number of metrics as pending and returns an ID to
+// be passed to done once they are handled.
+func (q *pendingQueue) add(metrics int, now time.Time) uint64 {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.entries == nil {
+		q.entries = make(map[uint64]pendingEntry)
+	}
+	id := q.next
+	q.next++
+	q.entries[id] = pendingEntry{metrics: metrics, since: now}
+	return id
+}
+
+func (q *pendingQueue) done(ids ...uint64) {
+	q.Lock()
+	defer q.Unlock()
+
+	for _, id := range ids {
+		delete(q.entries, id)
+	}
+}
+
+func (q *pendingQueue) stats(now time.Time) QueueStats {
+	q.Lock()
+	defer q.Unlock()
+
+	var stats QueueStats
+	for _, e := range q.entries {
+		stats.Metrics += e.metrics
+		if age := now.Sub(e.since); age > stats.OldestAge {
+			stats.OldestAge = age
+		}
+	}
+	return stats
+}
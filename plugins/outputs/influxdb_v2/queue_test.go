@@ -0,0 +1,25 @@
+package influxdb_v2
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPendingQueue(t *testing.T) {
+	var q pendingQueue
+	now := time.Unix(100, 0)
+
+	require.Equal(t, QueueStats{}, q.stats(now))
+
+	first := q.add(5, now.Add(-10*time.Second))
+	second := q.add(3, now.Add(-2*time.Second))
+	require.Equal(t, QueueStats{Metrics: 8, OldestAge: 10 * time.Second}, q.stats(now))
+
+	q.done(first)
+	require.Equal(t, QueueStats{Metrics: 3, OldestAge: 2 * time.Second}, q.stats(now))
+
+	q.done(second)
+	require.Equal(t, QueueStats{}, q.stats(now))
+}
@@ -0,0 +1,228 @@
+package influxdb_v2
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxRateLimitedBuckets limits the number of buckets with a request rate
+// limiter.
+const maxRateLimitedBuckets = 1000
+
+// rateLimiter is a token bucket refilled at the given rate per second up to
+// a burst of one second. Requests may take more tokens than available and
+// wait until the debt is paid off, so requests exceeding the burst on their
+// own still pass.
+type rateLimiter struct {
+	rate float64
+
+	sync.Mutex
+	tokens float64
+	last   time.Time
+
+	waiting   int
+	throttled uint64
+	waited    time.Duration
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: rate}
+}
+
+// refill adds the tokens accumulated since the last call, the lock must be
+// held.
+func (l *rateLimiter) refill(now time.Time) {
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+}
+
+// idle returns true if no request is held back and the burst is available
+// again, so the limiter is in the same state as a new one.
+func (l *rateLimiter) idle(now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	l.refill(now)
+	return l.waiting == 0 && l.tokens >= l.rate
+}
+
+// delay returns the time to wait before n tokens are available.
+func (l *rateLimiter) delay(n float64) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	l.refill(time.Now())
+	if l.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - l.tokens) / l.rate * float64(time.Second))
+}
+
+// wait takes n tokens and waits until they are available or the context is
+// done. Tokens of aborted waits are returned.
+func (l *rateLimiter) wait(ctx context.Context, n float64) error {
+	start := time.Now()
+	l.Lock()
+	l.refill(start)
+	l.tokens -= n
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	if delay > 0 {
+		l.waiting++
+		l.throttled++
+	}
+	l.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+	}
+
+	l.Lock()
+	if err != nil {
+		l.tokens += n
+	}
+	l.waiting--
+	l.waited += time.Since(start)
+	l.Unlock()
+	return err
+}
+
+// BucketThrottle holds the state of the request rate limit of a bucket.
+type BucketThrottle struct {
+	// Rate is the number of requests per second allowed.
+	Rate float64
+	// Waiting is the number of requests currently held back.
+	Waiting int
+	// Throttled is the total number of requests held back.
+	Throttled uint64
+	// Waited is the total time requests were held back.
+	Waited time.Duration
+}
+
+// bucketRateLimiter limits the request rate of each bucket independently
+// with a token bucket per bucket, so a busy bucket does not use up the rate
+// of the others. Only limited buckets are tracked, and idle limiters are
+// dropped once too many buckets are tracked.
+type bucketRateLimiter struct {
+	rate      float64
+	overrides map[string]float64
+
+	sync.Mutex
+	limiters map[string]*rateLimiter
+}
+
+func newBucketRateLimiter(rate float64, overrides map[string]float64) *bucketRateLimiter {
+	return &bucketRateLimiter{
+		rate:      rate,
+		overrides: overrides,
+		limiters:  make(map[string]*rateLimiter),
+	}
+}
+
+// limiter returns the limiter of the given bucket or nil if the requests
+// to the bucket are not limited.
+func (b *bucketRateLimiter) limiter(bucket string) *rateLimiter {
+	b.Lock()
+	defer b.Unlock()
+
+	if l, ok := b.limiters[bucket]; ok {
+		return l
+	}
+
+	rate, ok := b.overrides[bucket]
+	if !ok {
+		rate = b.rate
+	}
+	if rate <= 0 {
+		return nil
+	}
+	b.evict(time.Now())
+	l := newRateLimiter(rate)
+	b.limiters[bucket] = l
+	return l
+}
+
+// evict makes room for a new limiter, removing idle limiters first and
+// arbitrary ones if that is not enough. The lock must be held.
+func (b *bucketRateLimiter) evict(now time.Time) {
+	if len(b.limiters) < maxRateLimitedBuckets {
+		return
+	}
+	for bucket, l := range b.limiters {
+		if l.idle(now) {
+			delete(b.limiters, bucket)
+		}
+	}
+	for bucket := range b.limiters {
+		if len(b.limiters) < maxRateLimitedBuckets {
+			return
+		}
+		delete(b.limiters, bucket)
+	}
+}
+
+// wait waits until a request to the given bucket is allowed.
+func (b *bucketRateLimiter) wait(ctx context.Context, bucket string) error {
+	if l := b.limiter(bucket); l != nil {
+		return l.wait(ctx, 1)
+	}
+	return nil
+}
+
+// order sorts the buckets by the time until a request is allowed, so
+// requests to throttled buckets do not hold back the others.
+func (b *bucketRateLimiter) order(buckets []string) {
+	delays := make(map[string]time.Duration, len(buckets))
+	for _, bucket := range buckets {
+		if l := b.limiter(bucket); l != nil {
+			delays[bucket] = l.delay(1)
+		}
+	}
+	sort.SliceStable(buckets, func(i, j int) bool {
+		return delays[buckets[i]] < delays[buckets[j]]
+	})
+}
+
+// BucketThrottles returns a snapshot of the request rate limit state per
+// limited bucket. Nil is returned if no bucket rate limits are configured.
+// Idle buckets may be missing once many buckets are limited.
+func (c *httpClient) BucketThrottles() map[string]BucketThrottle {
+	if c.bucketRate == nil {
+		return nil
+	}
+	return c.bucketRate.snapshot()
+}
+
+func (b *bucketRateLimiter) snapshot() map[string]BucketThrottle {
+	b.Lock()
+	defer b.Unlock()
+
+	snapshot := make(map[string]BucketThrottle, len(b.limiters))
+	for bucket, l := range b.limiters {
+		l.Lock()
+		snapshot[bucket] = BucketThrottle{
+			Rate:      l.rate,
+			Waiting:   l.waiting,
+			Throttled: l.throttled,
+			Waited:    l.waited,
+		}
+		l.Unlock()
+	}
+	return snapshot
+}
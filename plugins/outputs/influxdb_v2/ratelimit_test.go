@@ -0,0 +1,151 @@
+package influxdb_v2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/plugins/serializers/influx"
+	"github.com/influxdata/telegraf/testutil"
+)
+
+// countingSerializer counts the metrics serialized one by one.
+type countingSerializer struct {
+	influx.Serializer
+	calls int
+}
+
+func (s *countingSerializer) Serialize(metric telegraf.Metric) ([]byte, error) {
+	s.calls++
+	return s.Serializer.Serialize(metric)
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(10)
+	ctx := context.Background()
+
+	// The burst passes right away
+	start := time.Now()
+	require.NoError(t, l.wait(ctx, 10))
+	require.Less(t, time.Since(start), 50*time.Millisecond)
+
+	// Further requests wait for the bucket to refill
+	start = time.Now()
+	require.NoError(t, l.wait(ctx, 2))
+	require.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	// Waiting is aborted by the context and the tokens are returned
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, l.wait(timeoutCtx, 100), context.DeadlineExceeded)
+	start = time.Now()
+	require.NoError(t, l.wait(ctx, 1))
+	require.Less(t, time.Since(start), 150*time.Millisecond)
+}
+
+func TestWriteSerializesOnce(t *testing.T) {
+	var received int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		atomic.AddInt64(&received, int64(len(body)))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	serializer := &countingSerializer{Serializer: *influx.NewSerializer()}
+	var stats WriteStats
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:               genURL(ts.URL),
+		Bucket:            "telegraf",
+		BodySerializer:    serializer,
+		MaxBytesPerSecond: 1024 * 1024,
+		MaxInFlightBytes:  1024 * 1024,
+		MirrorURL:         genURL(ts.URL),
+		OnWrite:           func(s WriteStats) { stats = s },
+		Log:               testutil.Logger{},
+	})
+	require.NoError(t, err)
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 2}, time.Unix(0, 0)),
+	}
+
+	// The body is used for the size checks, the statistics, the request and
+	// the mirror
+	require.NoError(t, c.Write(context.Background(), metrics))
+	require.NoError(t, c.Flush(context.Background()))
+	require.Equal(t, len(metrics), serializer.calls)
+	require.Equal(t, 2*stats.SerializedBytes, atomic.LoadInt64(&received))
+}
+
+func TestBucketRateLimiter(t *testing.T) {
+	l := newBucketRateLimiter(10, map[string]float64{"fast": 1000, "unlimited": 0})
+	ctx := context.Background()
+
+	// Use up the burst of the noisy bucket
+	for i := 0; i < 10; i++ {
+		require.NoError(t, l.wait(ctx, "noisy"))
+	}
+
+	// Other buckets are not held back by it
+	start := time.Now()
+	require.NoError(t, l.wait(ctx, "quiet"))
+	require.NoError(t, l.wait(ctx, "fast"))
+	require.NoError(t, l.wait(ctx, "unlimited"))
+	require.Less(t, time.Since(start), 50*time.Millisecond)
+
+	// Throttled buckets are sorted last
+	buckets := []string{"noisy", "quiet", "fast"}
+	l.order(buckets)
+	require.Equal(t, []string{"quiet", "fast", "noisy"}, buckets)
+
+	start = time.Now()
+	require.NoError(t, l.wait(ctx, "noisy"))
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	throttles := l.snapshot()
+	require.Len(t, throttles, 3)
+	require.Equal(t, 10.0, throttles["noisy"].Rate)
+	require.Equal(t, uint64(1), throttles["noisy"].Throttled)
+	require.GreaterOrEqual(t, throttles["noisy"].Waited, 50*time.Millisecond)
+	require.Zero(t, throttles["noisy"].Waiting)
+	require.Equal(t, 1000.0, throttles["fast"].Rate)
+	require.Zero(t, throttles["quiet"].Throttled)
+	require.NotContains(t, throttles, "unlimited")
+}
+
+func TestBucketRateLimiterBounded(t *testing.T) {
+	l := newBucketRateLimiter(1000, map[string]float64{"unlimited": 0})
+	ctx := context.Background()
+
+	// Unlimited buckets are not tracked
+	require.NoError(t, l.wait(ctx, "unlimited"))
+	require.Empty(t, l.snapshot())
+
+	// The number of tracked buckets is bounded
+	for i := 0; i < 2*maxRateLimitedBuckets; i++ {
+		require.NoError(t, l.wait(ctx, fmt.Sprintf("bucket%d", i)))
+	}
+	require.LessOrEqual(t, len(l.snapshot()), maxRateLimitedBuckets)
+
+	// Limiters in use are kept over idle ones
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, l.wait(ctx, "busy"))
+	}
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, l.wait(ctx, "new"))
+	throttles := l.snapshot()
+	require.Contains(t, throttles, "busy")
+	require.Contains(t, throttles, "new")
+	require.LessOrEqual(t, len(throttles), maxRateLimitedBuckets)
+}
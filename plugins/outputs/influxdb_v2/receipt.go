@@ -0,0 +1,54 @@
+package influxdb_v2
+
+import (
+	"net/http"
+	"time"
+)
+
+// Receipt describes a single attempt to write a batch of metrics.
+type Receipt struct {
+	// Bucket is the bucket written to.
+	Bucket string
+	// Metrics is the number of metrics in the batch.
+	Metrics int
+	// Bytes is the number of request body bytes sent, after compression.
+	Bytes int64
+	// StatusCode is the HTTP status of the response, zero if no response
+	// was received.
+	StatusCode int
+	// RequestID is the ID the server assigned to the request, if any.
+	RequestID string
+	// Latency is the time from sending the request to handling the response.
+	Latency time.Duration
+	// Err is the error returned for the attempt, nil on success.
+	Err error
+	// Warning is the error reported by the server in the X-Influx-Error
+	// header of a successful write, e.g. for partially accepted batches.
+	Warning string
+}
+
+// requestID returns the ID of the request as reported by the server.
+func requestID(header http.Header) string {
+	if id := header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	return header.Get("Request-Id")
+}
+
+// WriteStats describes the size and duration of a single write request.
+type WriteStats struct {
+	// Bucket is the bucket written to.
+	Bucket string
+	// SerializedBytes is the size of the request body before compression.
+	SerializedBytes int64
+	// CompressedBytes is the number of request body bytes sent, after
+	// compression.
+	CompressedBytes int64
+	// StatusCode is the HTTP status of the response, zero if no response
+	// was received.
+	StatusCode int
+	// Duration is the round-trip time of the request.
+	Duration time.Duration
+	// Err is the error returned for the request, nil on success.
+	Err error
+}
@@ -0,0 +1,163 @@
+package influxdb_v2
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+const (
+	// retentionFailureTTL is the time a failed retention lookup is cached,
+	// so writes are not delayed by repeated lookups while the API is down.
+	retentionFailureTTL = time.Minute
+
+	// maxCachedRetentions limits the number of buckets with a cached
+	// retention period.
+	maxCachedRetentions = 1000
+)
+
+// retentionEntry is the retention period of a bucket, zero meaning the data
+// never expires. The period is valid once done is closed.
+type retentionEntry struct {
+	period time.Duration
+	done   chan struct{}
+
+	// expires is the end of caching a failed lookup, successful lookups are
+	// cached until evicted.
+	expires time.Time
+}
+
+func (e *retentionEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// retentionCache holds the retention period of buckets.
+type retentionCache struct {
+	sync.Mutex
+	entries map[string]*retentionEntry
+}
+
+// evict makes room for a new entry, removing expired entries first and
+// arbitrary ones if that is not enough.
+func (r *retentionCache) evict(now time.Time) {
+	if len(r.entries) < maxCachedRetentions {
+		return
+	}
+	for bucket, e := range r.entries {
+		if e.expired(now) {
+			delete(r.entries, bucket)
+		}
+	}
+	for bucket := range r.entries {
+		if len(r.entries) < maxCachedRetentions {
+			return
+		}
+		delete(r.entries, bucket)
+	}
+}
+
+// retention returns the retention period of the given bucket, looking it
+// up on first use. Lookups of different buckets happen in parallel, while
+// writes to a bucket wait for the lookup in progress. Failed lookups are
+// logged and cached as infinite retention for a while, so writes are neither
+// blocked nor repeatedly delayed by them.
+func (c *httpClient) retention(ctx context.Context, bucket string) time.Duration {
+	now := time.Now()
+	c.retentions.Lock()
+	if e, ok := c.retentions.entries[bucket]; ok && !e.expired(now) {
+		c.retentions.Unlock()
+		select {
+		case <-e.done:
+			return e.period
+		case <-ctx.Done():
+			return 0
+		}
+	}
+	if c.retentions.entries == nil {
+		c.retentions.entries = make(map[string]*retentionEntry)
+	}
+	c.retentions.evict(now)
+	e := &retentionEntry{done: make(chan struct{})}
+	c.retentions.entries[bucket] = e
+	c.retentions.Unlock()
+
+	period, err := c.getRetention(ctx, bucket)
+	if err != nil {
+		c.log.Warnf("Looking up retention of bucket %q failed, not checking metric ages: %v", bucket, err)
+	}
+
+	c.retentions.Lock()
+	e.period = period
+	if err != nil {
+		e.expires = time.Now().Add(retentionFailureTTL)
+	}
+	c.retentions.Unlock()
+	close(e.done)
+	return period
+}
+
+// getRetention looks up the retention period of the given bucket.
+func (c *httpClient) getRetention(ctx context.Context, bucket string) (time.Duration, error) {
+	orgID, err := c.getOrgID(ctx)
+	if err != nil {
+		return 0, err
+	}
+	loc, err := makeBucketURL(*c.url, orgID, bucket)
+	if err != nil {
+		return 0, err
+	}
+
+	var buckets struct {
+		Buckets []struct {
+			Name           string `json:"name"`
+			RetentionRules []struct {
+				Type         string `json:"type"`
+				EverySeconds int64  `json:"everySeconds"`
+			} `json:"retentionRules"`
+		} `json:"buckets"`
+	}
+	if err := c.makeAPIRequest(ctx, "GET", loc, &buckets); err != nil {
+		c.forgetOrgID(err)
+		return 0, err
+	}
+	for _, b := range buckets.Buckets {
+		if b.Name != bucket {
+			continue
+		}
+		for _, rule := range b.RetentionRules {
+			if rule.Type == "expire" && rule.EverySeconds > 0 {
+				return time.Duration(rule.EverySeconds) * time.Second, nil
+			}
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("bucket %q not found", bucket)
+}
+
+// dropOutOfRetention removes the metrics older than the retention period of
+// the bucket, as the server would reject the whole batch because of them.
+func (c *httpClient) dropOutOfRetention(ctx context.Context, bucket string, metrics []telegraf.Metric, now time.Time) []telegraf.Metric {
+	period := c.retention(ctx, bucket)
+	if period == 0 {
+		return metrics
+	}
+
+	limit := now.Add(-period)
+	var dropped int
+	kept := make([]telegraf.Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		if metric.Time().Before(limit) {
+			dropped++
+			continue
+		}
+		kept = append(kept, metric)
+	}
+	if dropped > 0 {
+		c.log.Warnf("Dropped %d metric(s) older than the retention period %s of bucket %q", dropped, period, bucket)
+		c.metrics.drop(dropOutOfRetention, dropped)
+	}
+	return kept
+}
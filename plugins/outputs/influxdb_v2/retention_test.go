@@ -0,0 +1,230 @@
+package influxdb_v2
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/testutil"
+)
+
+func TestDropOutOfRetention(t *testing.T) {
+	var lookups int
+	var written []string
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/api/v2/orgs":
+				_, _ = w.Write([]byte(`{"orgs": [{"id": "1234", "name": "influx"}]}`))
+			case "/api/v2/buckets":
+				lookups++
+				require.Equal(t, "1234", r.URL.Query().Get("orgID"))
+				_, _ = w.Write([]byte(`{"buckets": [{"name": "telegraf", "retentionRules": [{"type": "expire", "everySeconds": 3600}]}]}`))
+			case "/api/v2/write":
+				body, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				written = append(written, strings.Fields(string(body))[1])
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:                genURL(ts.URL),
+		Organization:       "influx",
+		Bucket:             "telegraf",
+		DropOutOfRetention: true,
+		Log:                testutil.Logger{},
+	})
+	require.NoError(t, err)
+
+	now := time.Now()
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, now.Add(-2*time.Hour)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 2}, now.Add(-time.Minute)),
+	}
+	require.NoError(t, c.Write(context.Background(), metrics))
+	require.Equal(t, []string{"value=2i"}, written)
+
+	// The retention is cached and batches of expired metrics are not sent
+	require.NoError(t, c.Write(context.Background(), metrics[:1]))
+	require.Equal(t, []string{"value=2i"}, written)
+	require.Equal(t, 1, lookups)
+}
+
+func TestDropOutOfRetentionLookupFailure(t *testing.T) {
+	var writes, lookups int
+	lookupStatus := http.StatusForbidden
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/api/v2/write":
+				writes++
+				w.WriteHeader(http.StatusNoContent)
+			case "/api/v2/orgs":
+				_, _ = w.Write([]byte(`{"orgs": [{"id": "1234", "name": "influx"}]}`))
+			case "/api/v2/buckets":
+				lookups++
+				w.WriteHeader(lookupStatus)
+				_, _ = w.Write([]byte(`{"buckets": [{"name": "telegraf", "retentionRules": [{"type": "expire", "everySeconds": 3600}]}]}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:                genURL(ts.URL),
+		Organization:       "influx",
+		Bucket:             "telegraf",
+		DropOutOfRetention: true,
+		Log:                testutil.Logger{},
+	})
+	require.NoError(t, err)
+
+	// Metrics are written unchecked if the retention is unknown
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+	}
+	require.NoError(t, c.Write(context.Background(), metrics))
+	require.Equal(t, 1, writes)
+
+	// The failure is cached for a while only
+	lookupStatus = http.StatusOK
+	require.NoError(t, c.Write(context.Background(), metrics))
+	require.Equal(t, 2, writes)
+	require.Equal(t, 1, lookups)
+
+	c.retentions.entries["telegraf"].expires = time.Now()
+	require.NoError(t, c.Write(context.Background(), metrics))
+	require.Equal(t, 2, writes)
+	require.Equal(t, 2, lookups)
+}
+
+func TestRetentionLookupsInParallel(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/api/v2/orgs":
+				_, _ = w.Write([]byte(`{"orgs": [{"id": "1234", "name": "influx"}]}`))
+			case "/api/v2/buckets":
+				name := r.URL.Query().Get("name")
+				if name == "slow" {
+					<-release
+				}
+				_, _ = w.Write([]byte(`{"buckets": [{"name": "` + name + `", "retentionRules": [{"type": "expire", "everySeconds": 60}]}]}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:          genURL(ts.URL),
+		Organization: "influx",
+		Bucket:       "telegraf",
+		Log:          testutil.Logger{},
+	})
+	require.NoError(t, err)
+	_, err = c.getOrgID(context.Background())
+	require.NoError(t, err)
+
+	// A slow lookup does not block the lookups of other buckets
+	slow := make(chan time.Duration)
+	go func() {
+		slow <- c.retention(context.Background(), "slow")
+	}()
+	require.Eventually(t, func() bool {
+		c.retentions.Lock()
+		defer c.retentions.Unlock()
+		return c.retentions.entries["slow"] != nil
+	}, time.Second, time.Millisecond)
+	require.Equal(t, time.Minute, c.retention(context.Background(), "fast"))
+
+	// Writes to the same bucket wait for the lookup in progress
+	waiting := make(chan time.Duration)
+	go func() {
+		waiting <- c.retention(context.Background(), "slow")
+	}()
+	close(release)
+	require.Equal(t, time.Minute, <-slow)
+	require.Equal(t, time.Minute, <-waiting)
+}
+
+func TestRetentionCacheBounded(t *testing.T) {
+	now := time.Now()
+	var r retentionCache
+	r.entries = make(map[string]*retentionEntry)
+	for i := 0; i < maxCachedRetentions; i++ {
+		r.entries[strconv.Itoa(i)] = &retentionEntry{}
+	}
+	r.entries["0"].expires = now
+
+	// Expired entries are removed first
+	r.evict(now)
+	require.Len(t, r.entries, maxCachedRetentions-1)
+	require.NotContains(t, r.entries, "0")
+
+	r.entries["0"] = &retentionEntry{}
+	r.evict(now)
+	require.Len(t, r.entries, maxCachedRetentions-1)
+}
+
+func TestOrgIDCached(t *testing.T) {
+	var orgLookups int
+	bucketStatus := http.StatusOK
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/api/v2/orgs":
+				orgLookups++
+				_, _ = w.Write([]byte(`{"orgs": [{"id": "1234", "name": "influx"}]}`))
+			case "/api/v2/buckets":
+				require.Equal(t, "1234", r.URL.Query().Get("orgID"))
+				w.WriteHeader(bucketStatus)
+				_, _ = w.Write([]byte(`{"buckets": [{"name": "` + r.URL.Query().Get("name") + `"}]}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:          genURL(ts.URL),
+		Organization: "influx",
+		Bucket:       "telegraf",
+		Log:          testutil.Logger{},
+	})
+	require.NoError(t, err)
+
+	// Looking up several new buckets resolves the organization only once
+	for _, bucket := range []string{"a", "b", "c"} {
+		_, err := c.getRetention(context.Background(), bucket)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, orgLookups)
+
+	// Rejected credentials invalidate the cached ID
+	bucketStatus = http.StatusUnauthorized
+	_, err = c.getRetention(context.Background(), "d")
+	require.Error(t, err)
+	bucketStatus = http.StatusOK
+	_, err = c.getRetention(context.Background(), "d")
+	require.NoError(t, err)
+	require.Equal(t, 2, orgLookups)
+}
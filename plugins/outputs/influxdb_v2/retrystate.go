@@ -0,0 +1,111 @@
+package influxdb_v2
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// retryStateMu serializes access to retry state files shared by the clients
+// of all URLs.
+var retryStateMu sync.Mutex
+
+// retryState is the backoff state of a client persisted across restarts.
+type retryState struct {
+	Start time.Time `json:"start"`
+	Time  time.Time `json:"time"`
+	Count int       `json:"count"`
+}
+
+// readRetryStates reads the states of all clients from the given file keyed
+// by URL. A missing file holds no states.
+func readRetryStates(path string) (map[string]retryState, error) {
+	states := make(map[string]retryState)
+	octets, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return states, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(octets, &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// loadRetryState restores the backoff persisted by a previous run, unless
+// the wait has elapsed already and the state is stale.
+func (c *httpClient) loadRetryState(now time.Time) error {
+	retryStateMu.Lock()
+	defer retryStateMu.Unlock()
+
+	states, err := readRetryStates(c.RetryStateFile)
+	if err != nil {
+		return err
+	}
+	state, ok := states[c.url.Redacted()]
+	if !ok || !state.Time.After(now) {
+		return nil
+	}
+
+	c.retryStart = state.Start
+	c.retryTime = state.Time
+	c.retryCount = state.Count
+	c.savedRetryState = state
+	return nil
+}
+
+// saveRetryState persists the backoff if it changed since last saved. The
+// file is replaced atomically so a crash never leaves a truncated state.
+func (c *httpClient) saveRetryState() {
+	c.retryMu.Lock()
+	state := retryState{Start: c.retryStart, Time: c.retryTime, Count: c.retryCount}
+	c.retryMu.Unlock()
+	if state == c.savedRetryState {
+		return
+	}
+
+	if err := c.writeRetryState(state); err != nil {
+		c.log.Errorf("Saving retry state to %q failed: %v", c.RetryStateFile, err)
+		return
+	}
+	c.savedRetryState = state
+}
+
+func (c *httpClient) writeRetryState(state retryState) error {
+	retryStateMu.Lock()
+	defer retryStateMu.Unlock()
+
+	states, err := readRetryStates(c.RetryStateFile)
+	if err != nil {
+		return err
+	}
+	if state.Time.IsZero() && state.Count == 0 {
+		delete(states, c.url.Redacted())
+	} else {
+		states[c.url.Redacted()] = state
+	}
+
+	octets, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.RetryStateFile), filepath.Base(c.RetryStateFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(octets); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.RetryStateFile)
+}
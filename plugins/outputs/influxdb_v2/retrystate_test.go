@@ -0,0 +1,81 @@
+package influxdb_v2
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/testutil"
+)
+
+func TestRetryStatePersisted(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(status)
+		}),
+	)
+	defer ts.Close()
+
+	config := &HTTPConfig{
+		URL:            genURL(ts.URL),
+		Bucket:         "telegraf",
+		RetryStateFile: filepath.Join(t.TempDir(), "retry.json"),
+		Log:            testutil.Logger{},
+	}
+	c, err := NewHTTPClient(config)
+	require.NoError(t, err)
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 42.0}, time.Unix(0, 0)),
+	}
+	require.Error(t, c.Write(context.Background(), metrics))
+	require.FileExists(t, config.RetryStateFile)
+
+	// A restarted client keeps waiting
+	restarted, err := NewHTTPClient(config)
+	require.NoError(t, err)
+	require.Equal(t, c.retryCount, restarted.retryCount)
+	require.WithinDuration(t, c.retryTime, restarted.retryTime, time.Millisecond)
+	require.ErrorContains(t, restarted.Write(context.Background(), metrics), "retry time has not elapsed")
+
+	// The state is removed once writes succeed again
+	status = http.StatusNoContent
+	restarted.retryTime = time.Time{}
+	require.NoError(t, restarted.Write(context.Background(), metrics))
+	states, err := readRetryStates(config.RetryStateFile)
+	require.NoError(t, err)
+	require.Empty(t, states)
+}
+
+func TestRetryStateStale(t *testing.T) {
+	c := &httpClient{
+		url:            genURL("http://localhost:8086"),
+		RetryStateFile: filepath.Join(t.TempDir(), "retry.json"),
+		retryStart:     time.Now().Add(-2 * time.Minute),
+		retryTime:      time.Now().Add(-time.Minute),
+		retryCount:     3,
+	}
+	require.NoError(t, c.writeRetryState(retryState{Start: c.retryStart, Time: c.retryTime, Count: c.retryCount}))
+
+	restarted := &httpClient{url: c.url, RetryStateFile: c.RetryStateFile}
+	require.NoError(t, restarted.loadRetryState(time.Now()))
+	require.True(t, restarted.retryTime.IsZero())
+	require.Zero(t, restarted.retryCount)
+}
+
+func TestRetryStateCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "retry.json")
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0600))
+
+	c := &httpClient{url: genURL("http://localhost:8086"), RetryStateFile: path}
+	require.Error(t, c.loadRetryState(time.Now()))
+}
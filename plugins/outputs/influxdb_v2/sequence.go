@@ -0,0 +1,48 @@
+package influxdb_v2
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+// batchSequencer numbers the batches written by a client. A batch failing
+// to write keeps its number, so resending it unchanged reuses the number.
+// At most limit failed batches are remembered, further ones get a new
+// number when resent.
+type batchSequencer struct {
+	limit int
+
+	sync.Mutex
+	last   uint64
+	failed map[[sha256.Size]byte]uint64
+}
+
+// number returns the sequence number of the batch with the given key.
+func (s *batchSequencer) number(key [sha256.Size]byte) uint64 {
+	s.Lock()
+	defer s.Unlock()
+
+	if seq, ok := s.failed[key]; ok {
+		return seq
+	}
+	s.last++
+	return s.last
+}
+
+// done records the result of writing the batch with the given key.
+func (s *batchSequencer) done(key [sha256.Size]byte, seq uint64, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err == nil {
+		delete(s.failed, key)
+		return
+	}
+	if _, ok := s.failed[key]; !ok && len(s.failed) >= s.limit {
+		return
+	}
+	if s.failed == nil {
+		s.failed = make(map[[sha256.Size]byte]uint64)
+	}
+	s.failed[key] = seq
+}
@@ -0,0 +1,26 @@
+package influxdb_v2
+
+import (
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchSequencer(t *testing.T) {
+	s := &batchSequencer{limit: 1}
+	first := sha256.Sum256([]byte("first"))
+	second := sha256.Sum256([]byte("second"))
+
+	require.EqualValues(t, 1, s.number(first))
+	s.done(first, 1, errors.New("failed"))
+	require.EqualValues(t, 2, s.number(second))
+	s.done(second, 2, errors.New("failed"))
+
+	// Only the first failed batch is remembered due to the limit
+	require.EqualValues(t, 1, s.number(first))
+	require.EqualValues(t, 3, s.number(second))
+	s.done(first, 1, nil)
+	require.EqualValues(t, 4, s.number(first))
+}
@@ -0,0 +1,31 @@
+package influxdb_v2
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptrace"
+	"sync/atomic"
+	"syscall"
+)
+
+// traceReuse records whether the request is sent over a reused connection.
+func traceReuse(ctx context.Context, reused *int32) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.StoreInt32(reused, 1)
+			}
+		},
+	})
+}
+
+// isStaleConnError returns true if the error indicates that the connection
+// was closed by the server or a middlebox in between while idle, e.g. after
+// a NAT gateway dropped it silently.
+func isStaleConnError(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,64 @@
+package influxdb_v2
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/testutil"
+)
+
+func TestWriteResendOnStaleConnection(t *testing.T) {
+	// Close connections without a response on their second request, like a
+	// server or NAT gateway dropping idle connections
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	var written, dropped int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body)
+
+		mu.Lock()
+		requests[r.RemoteAddr]++
+		stale := requests[r.RemoteAddr] > 1
+		if stale {
+			dropped++
+		} else {
+			written++
+		}
+		mu.Unlock()
+
+		if stale {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			conn.Close()
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	c, err := NewHTTPClient(&HTTPConfig{
+		URL:    genURL(ts.URL),
+		Bucket: "telegraf",
+		Log:    testutil.Logger{},
+	})
+	require.NoError(t, err)
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+	}
+	require.NoError(t, c.Write(context.Background(), metrics))
+	require.NoError(t, c.Write(context.Background(), metrics))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 2, written)
+	require.Equal(t, 1, dropped)
+}
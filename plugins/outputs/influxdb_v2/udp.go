@@ -0,0 +1,116 @@
+package influxdb_v2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/plugins/serializers/influx"
+)
+
+const (
+	// maxUDPPayloadSize is the maximum length of a datagram payload, longer
+	// lines are split by the serializer.
+	maxUDPPayloadSize = 512
+
+	// defaultUDPFallbackAfter is the number of consecutive failed writes
+	// before falling back to UDP.
+	defaultUDPFallbackAfter = 3
+)
+
+// udpFallback sends line protocol over UDP without any delivery guarantee
+// as a last resort while writes over HTTP are failing.
+type udpFallback struct {
+	url        *url.URL
+	serializer *influx.Serializer
+	conn       net.Conn
+}
+
+func newUDPFallback(u *url.URL) (*udpFallback, error) {
+	switch u.Scheme {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("unsupported scheme: %q", u.Scheme)
+	}
+
+	serializer := influx.NewSerializer()
+	serializer.SetMaxLineBytes(maxUDPPayloadSize)
+
+	return &udpFallback{url: u, serializer: serializer}, nil
+}
+
+// write sends every line of the metrics in a datagram of its own. Datagrams
+// are fire-and-forget, so a nil error does not mean the metrics arrived.
+func (f *udpFallback) write(ctx context.Context, metrics []telegraf.Metric) error {
+	if f.conn == nil {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, f.url.Scheme, f.url.Host)
+		if err != nil {
+			return fmt.Errorf("error dialing address [%s]: %w", f.url, err)
+		}
+		f.conn = conn
+	}
+
+	for _, metric := range metrics {
+		octets, err := f.serializer.Serialize(metric)
+		if err != nil {
+			continue
+		}
+
+		for len(octets) > 0 {
+			n := len(octets)
+			if i := bytes.IndexByte(octets, '\n'); i >= 0 {
+				n = i + 1
+			}
+			if _, err := f.conn.Write(octets[:n]); err != nil {
+				f.close()
+				return err
+			}
+			octets = octets[n:]
+		}
+	}
+	return nil
+}
+
+func (f *udpFallback) close() {
+	if f.conn != nil {
+		f.conn.Close()
+		f.conn = nil
+	}
+}
+
+// countHTTPFailure tracks consecutive writes failing due to the server
+// being unreachable or unavailable. Errors caused by the request, such as
+// authentication failures, are not counted.
+func (c *httpClient) countHTTPFailure(err error) {
+	if err == nil {
+		c.httpFailures = 0
+		return
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode < 500 {
+		return
+	}
+	c.httpFailures++
+}
+
+// udpFallbackActive returns true if writes failed often enough to fall back
+// to UDP.
+func (c *httpClient) udpFallbackActive() bool {
+	return c.udpFallback != nil && c.httpFailures >= c.UDPFallbackAfter
+}
+
+// writeUDPFallback sends the metrics over UDP instead of HTTP. The metrics
+// are considered delivered if sending succeeds.
+func (c *httpClient) writeUDPFallback(ctx context.Context, bucket string, metrics []telegraf.Metric) error {
+	if err := c.udpFallback.write(ctx, metrics); err != nil {
+		return fmt.Errorf("UDP fallback: %w", err)
+	}
+	c.logWarnf("Writes over HTTP are failing, sent metrics for %s over UDP to %s", bucket, c.udpFallback.url)
+	return nil
+}